@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/* Final labels for documents assessors disagree on:
+
+CREATE TABLE adjudication (
+
+	topic_id bigint NOT NULL,
+
+	doc_id bigint NOT NULL,
+
+	adjudicator int NOT NULL,
+
+	relevant assessType NOT NULL,
+
+	date_adjudicated TIMESTAMP,
+
+	PRIMARY KEY (topic_id, doc_id),
+
+	FOREIGN KEY (adjudicator) REFERENCES users (user_id)
+
+);*/
+
+// An assessor's judgment and tags, shown side by side when adjudicating.
+type assessorJudgment struct {
+
+	UserId int64 `json:"user_id"`
+
+	Name string `json:"name"`
+
+	Relevance string `json:"relevance"`
+
+	Tags []Tag `json:"tags"`
+
+}
+
+type adjudicationRequest struct {
+
+	TopicId int64 `json:"topic"`
+
+	DocId int64 `json:"doc"`
+
+	Relevance string `json:"relevance"`
+
+}
+
+// Docs in a topic judged with more than one grade, not yet adjudicated first.
+func (i *Instance) adjudicationQueue(userId int64, topicId string) ([]ApiCaseResponse, error) {
+	docs, err := dbGetDisagreements(i.db, topicId)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return []ApiCaseResponse{}, nil
+	}
+	adjudicated, err := dbGetAdjudicated(i.db, topicId)
+	if err != nil {
+		return nil, err
+	}
+
+	api, err := i.elasticIdsQuery(userId, topicId, docs)
+	if err != nil {
+		return nil, err
+	}
+	hits := api.Results
+	for j := range hits {
+		hits[j].Relevance, hits[j].Stored = adjudicated[hits[j].Id]
+	}
+	sort.SliceStable(hits, func(a, b int) bool {
+		return !hits[a].Stored && hits[b].Stored
+	})
+	return hits, nil
+}
+
+func dbGetDisagreements(db *sql.DB, topicId string) ([]string, error) {
+	rows, err := db.Query("SELECT doc_id FROM assessment WHERE topic_id = $1 AND relevant IS NOT NULL GROUP BY doc_id HAVING COUNT(DISTINCT relevant) > 1 ORDER BY doc_id",
+		topicId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	docs := make([]string, 0)
+	for rows.Next() {
+		var doc_id string
+		err = rows.Scan(&doc_id)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc_id)
+	}
+	return docs, rows.Err()
+}
+
+// Doc id to adjudicated label for a topic.
+func dbGetAdjudicated(db *sql.DB, topicId string) (map[string]string, error) {
+	rows, err := db.Query("SELECT doc_id, relevant FROM adjudication WHERE topic_id = $1",
+		topicId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	adjudicated := map[string]string{}
+	for rows.Next() {
+		var doc_id string
+		var relevance string
+		err = rows.Scan(&doc_id, &relevance)
+		if err != nil {
+			return nil, err
+		}
+		adjudicated[doc_id] = relevance
+	}
+	return adjudicated, rows.Err()
+}
+
+// Every adjudicated label, keyed by topic and doc.
+func dbGetAdjudications(db *sql.DB) (map[[2]int64]string, error) {
+	rows, err := db.Query("SELECT topic_id, doc_id, relevant FROM adjudication")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	adjudicated := map[[2]int64]string{}
+	for rows.Next() {
+		var topic_id, doc_id int64
+		var relevance string
+		err = rows.Scan(&topic_id, &doc_id, &relevance)
+		if err != nil {
+			return nil, err
+		}
+		adjudicated[[2]int64{topic_id, doc_id}] = relevance
+	}
+	return adjudicated, rows.Err()
+}
+
+func dbSaveAdjudication(db *sql.DB, a adjudicationRequest, user int64, date time.Time) (sql.Result, error) {
+	return db.Exec("INSERT INTO adjudication (topic_id, doc_id, adjudicator, relevant, date_adjudicated) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (topic_id, doc_id) DO UPDATE SET adjudicator = EXCLUDED.adjudicator, relevant = EXCLUDED.relevant, date_adjudicated = EXCLUDED.date_adjudicated",
+		a.TopicId, a.DocId, user, a.Relevance, date)
+}
+
+func dbGetDocJudgments(db *sql.DB, topicId, docId string) ([]assessorJudgment, error) {
+	rows, err := db.Query("SELECT a.assessor, u.name, a.relevant FROM assessment a JOIN users u ON u.user_id = a.assessor WHERE a.topic_id = $1 AND a.doc_id = $2 ORDER BY u.name",
+		topicId, docId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	judgments := make([]assessorJudgment, 0)
+	for rows.Next() {
+		var j assessorJudgment
+		var relevance sql.NullString
+		err = rows.Scan(&j.UserId, &j.Name, &relevance)
+		if err != nil {
+			return nil, err
+		}
+		j.Relevance = relevance.String
+		judgments = append(judgments, j)
+	}
+	return judgments, rows.Err()
+}
+
+// Handlers ---------------------------------------------------------------------
+
+func adjudicationQueueHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	vars := mux.Vars(r)
+	topicId, ok := vars["topicId"]; if !ok {
+		return 400, nil
+	}
+	log.Printf("user %d - adjudication queue - %s.\n", auth, topicId)
+
+	hits, err := i.adjudicationQueue(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(TopicData{
+		Queries: []queryRes{},
+		Results: hits,
+	})
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func adjudicationDocHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	topicId, ok := vars["topicId"]; if !ok {
+		return 400, nil
+	}
+	docId, ok := vars["docId"]; if !ok {
+		return 400, nil
+	}
+
+	judgments, err := dbGetDocJudgments(i.db, topicId, docId)
+	if err != nil {
+		return 500, err
+	}
+	for j := range judgments {
+		tags, err := dbGetTags(i.db, topicId, docId, judgments[j].UserId)
+		if err != nil {
+			return 500, err
+		}
+		judgments[j].Tags, err = i.anchorTags(docId, tags)
+		if err != nil {
+			return 500, err
+		}
+	}
+
+	buff, err := json.Marshal(judgments)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func apiAdjudicate(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 500, err
+	}
+	var req adjudicationRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return 400, err
+	}
+	if _, ok := i.grades()[req.Relevance]; !ok {
+		return 400, fmt.Errorf("Unknown relevance %q", req.Relevance)
+	}
+
+	// Only documents in the topic's queue can be adjudicated.
+	topicId := strconv.FormatInt(req.TopicId, 10)
+	if _, ok := i.topics[topicId]; !ok {
+		return 404, fmt.Errorf("No topic %s", topicId)
+	}
+	disagreements, err := dbGetDisagreements(i.db, topicId)
+	if err != nil {
+		return 500, err
+	}
+	queued := false
+	for _, d := range disagreements {
+		queued = queued || d == strconv.FormatInt(req.DocId, 10)
+	}
+	if !queued {
+		return 400, fmt.Errorf("Document %d is not in disagreement for topic %s", req.DocId, topicId)
+	}
+
+	_, err = dbSaveAdjudication(i.db, req, auth, time.Now())
+	if err != nil {
+		return 500, err
+	}
+	log.Printf("user %d - adjudicated %d - %d as %s.\n", auth, req.TopicId, req.DocId, req.Relevance)
+	return 200, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// stat is a statistic that may be undefined (NaN), ie. kappa when both
+// assessors only ever used one grade. Undefined values are written as null.
+type stat float64
+
+func (s stat) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(float64(s)) || math.IsInf(float64(s), 0) {
+		return []byte("null"), nil
+	}
+	return json.Marshal(float64(s))
+}
+
+type PairAgreement struct {
+
+	A string `json:"a"`
+
+	B string `json:"b"`
+
+	// Documents judged by both.
+	N int `json:"n"`
+
+	Kappa stat `json:"kappa"`
+
+	// Quadratic weighted kappa over the ordered grades.
+	WeightedKappa stat `json:"weighted_kappa"`
+
+	// Confusion[x][y] counts documents A graded x and B graded y.
+	Confusion [][]int `json:"confusion"`
+
+}
+
+type TopicAgreement struct {
+
+	TopicId string `json:"topic"`
+
+	// Documents judged by two or more assessors.
+	Units int `json:"units"`
+
+	Alpha stat `json:"alpha"`
+
+	OrdinalAlpha stat `json:"ordinal_alpha"`
+
+	Pairs []PairAgreement `json:"pairs"`
+
+}
+
+type AgreementReport struct {
+
+	// Grade labels in order, indexing the confusion matrices.
+	Labels []string `json:"labels"`
+
+	Topics []TopicAgreement `json:"topics"`
+
+	// Each assessor pair over all topics.
+	Pairs []PairAgreement `json:"pairs"`
+
+}
+
+// Labels ordered by grade, and each label's index into that order.
+func (i *Instance) gradeLabels() ([]string, map[string]int) {
+	grades := i.grades()
+	labels := make([]string, 0, len(grades))
+	for l := range grades {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(a, b int) bool {
+		if grades[labels[a]] != grades[labels[b]] {
+			return grades[labels[a]] < grades[labels[b]]
+		}
+		return labels[a] < labels[b]
+	})
+	index := map[string]int{}
+	for j, l := range labels {
+		index[l] = j
+	}
+	return labels, index
+}
+
+func (i *Instance) agreementReport() (*AgreementReport, error) {
+	assessments, err := dbGetAssessments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	users, err := dbGetUsers(i.db)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int64]string{}
+	for _, u := range users {
+		names[u.Id] = u.Name
+	}
+	labels, index := i.gradeLabels()
+
+	// topic -> doc -> assessor -> grade index
+	judged := map[int64]map[int64]map[int64]int{}
+	for _, a := range assessments {
+		g, ok := index[a.Relevance]
+		if !ok {
+			continue
+		}
+		if _, ok := judged[a.TopicId]; !ok {
+			judged[a.TopicId] = map[int64]map[int64]int{}
+		}
+		if _, ok := judged[a.TopicId][a.DocId]; !ok {
+			judged[a.TopicId][a.DocId] = map[int64]int{}
+		}
+		judged[a.TopicId][a.DocId][a.UserId] = g
+	}
+
+	type pair struct{ a, b int64 }
+	overall := map[pair][][]int{}
+	k := len(labels)
+
+	report := &AgreementReport{Labels: labels, Topics: []TopicAgreement{}, Pairs: []PairAgreement{}}
+	for topic, docs := range judged {
+		units := [][]int{}
+		matrices := map[pair][][]int{}
+		for _, byUser := range docs {
+			if len(byUser) < 2 {
+				continue
+			}
+			ids := make([]int64, 0, len(byUser))
+			unit := make([]int, 0, len(byUser))
+			for u, g := range byUser {
+				ids = append(ids, u)
+				unit = append(unit, g)
+			}
+			units = append(units, unit)
+
+			sort.Slice(ids, func(x, y int) bool { return ids[x] < ids[y] })
+			for x := range ids {
+				for y := x + 1; y < len(ids); y++ {
+					p := pair{ids[x], ids[y]}
+					if _, ok := matrices[p]; !ok {
+						matrices[p] = newMatrix(k)
+					}
+					if _, ok := overall[p]; !ok {
+						overall[p] = newMatrix(k)
+					}
+					matrices[p][byUser[p.a]][byUser[p.b]]++
+					overall[p][byUser[p.a]][byUser[p.b]]++
+				}
+			}
+		}
+		if len(units) == 0 {
+			continue
+		}
+
+		t := TopicAgreement{
+			TopicId: strconv.FormatInt(topic, 10),
+			Units: len(units),
+			Alpha: stat(krippendorffAlpha(units, k, nominalDistance)),
+			OrdinalAlpha: stat(krippendorffAlpha(units, k, ordinalDistance)),
+			Pairs: []PairAgreement{},
+		}
+		for p, m := range matrices {
+			t.Pairs = append(t.Pairs, pairAgreement(names[p.a], names[p.b], m))
+		}
+		sortPairs(t.Pairs)
+		report.Topics = append(report.Topics, t)
+	}
+
+	for p, m := range overall {
+		report.Pairs = append(report.Pairs, pairAgreement(names[p.a], names[p.b], m))
+	}
+	sortPairs(report.Pairs)
+	sort.Slice(report.Topics, func(a, b int) bool {
+		x, _ := strconv.Atoi(report.Topics[a].TopicId)
+		y, _ := strconv.Atoi(report.Topics[b].TopicId)
+		return x < y
+	})
+	return report, nil
+}
+
+func sortPairs(p []PairAgreement) {
+	sort.Slice(p, func(a, b int) bool {
+		if p[a].A != p[b].A {
+			return p[a].A < p[b].A
+		}
+		return p[a].B < p[b].B
+	})
+}
+
+func newMatrix(k int) [][]int {
+	m := make([][]int, k)
+	for j := range m {
+		m[j] = make([]int, k)
+	}
+	return m
+}
+
+func pairAgreement(a, b string, m [][]int) PairAgreement {
+	n := 0
+	for x := range m {
+		for y := range m[x] {
+			n += m[x][y]
+		}
+	}
+	return PairAgreement{
+		A: a,
+		B: b,
+		N: n,
+		Kappa: stat(cohenKappa(m)),
+		WeightedKappa: stat(weightedKappa(m)),
+		Confusion: m,
+	}
+}
+
+// Statistics ---------------------------------------------------------------------
+
+func cohenKappa(m [][]int) float64 {
+	return weightedKappaFn(m, func(x, y, k int) float64 {
+		if x == y {
+			return 0
+		}
+		return 1
+	})
+}
+
+func weightedKappa(m [][]int) float64 {
+	return weightedKappaFn(m, func(x, y, k int) float64 {
+		d := float64(x - y) / float64(k - 1)
+		return d * d
+	})
+}
+
+// kappa = 1 - sum(w * observed) / sum(w * expected), with disagreement
+// weights w. Unweighted kappa is the special case of 0/1 weights.
+func weightedKappaFn(m [][]int, w func(x, y, k int) float64) float64 {
+	k := len(m)
+	rows := make([]float64, k)
+	cols := make([]float64, k)
+	n := 0.0
+	for x := range m {
+		for y := range m[x] {
+			rows[x] += float64(m[x][y])
+			cols[y] += float64(m[x][y])
+			n += float64(m[x][y])
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+
+	observed, expected := 0.0, 0.0
+	for x := 0; x < k; x++ {
+		for y := 0; y < k; y++ {
+			wt := w(x, y, k)
+			observed += wt * float64(m[x][y])
+			expected += wt * rows[x] * cols[y] / n
+		}
+	}
+	if expected == 0 {
+		return math.NaN()
+	}
+	return 1 - observed / expected
+}
+
+// Squared distance between categories c and k, given the marginal count of
+// each category.
+type alphaDistance func(c, k int, counts []float64) float64
+
+func nominalDistance(c, k int, counts []float64) float64 {
+	if c == k {
+		return 0
+	}
+	return 1
+}
+
+func ordinalDistance(c, k int, counts []float64) float64 {
+	if c > k {
+		c, k = k, c
+	}
+	sum := 0.0
+	for g := c; g <= k; g++ {
+		sum += counts[g]
+	}
+	d := sum - (counts[c] + counts[k]) / 2
+	return d * d
+}
+
+// Krippendorff's alpha over units (documents) each holding the category
+// index given by every assessor who judged it. Units with fewer than two
+// values are not pairable and are ignored.
+func krippendorffAlpha(units [][]int, k int, delta alphaDistance) float64 {
+	o := make([][]float64, k)
+	for j := range o {
+		o[j] = make([]float64, k)
+	}
+	for _, u := range units {
+		m := len(u)
+		if m < 2 {
+			continue
+		}
+		for x := range u {
+			for y := range u {
+				if x != y {
+					o[u[x]][u[y]] += 1 / float64(m - 1)
+				}
+			}
+		}
+	}
+
+	counts := make([]float64, k)
+	n := 0.0
+	for c := range o {
+		for j := range o[c] {
+			counts[c] += o[c][j]
+		}
+		n += counts[c]
+	}
+	if n <= 1 {
+		return math.NaN()
+	}
+
+	observed, expected := 0.0, 0.0
+	for c := 0; c < k; c++ {
+		for j := 0; j < k; j++ {
+			d := delta(c, j, counts)
+			observed += o[c][j] * d
+			expected += counts[c] * counts[j] * d
+		}
+	}
+	if expected == 0 {
+		return math.NaN()
+	}
+	return 1 - (n - 1) * observed / expected
+}
+
+// Handlers -----------------------------------------------------------------------
+
+func agreementViewHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	i.templates["agreement"].Execute(w, struct{ TagCategories []string }{i.tagCategories()})
+	return 200, nil
+}
+
+func agreementHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	report, err := i.agreementReport()
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(report)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
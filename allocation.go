@@ -0,0 +1,464 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Topics are allocated to assessors in the assignment table:
+
+CREATE TABLE assignment (
+
+	topic_id bigint NOT NULL,
+
+	user_id int NOT NULL,
+
+	date_assigned TIMESTAMP,
+
+	PRIMARY KEY (topic_id, user_id),
+
+	FOREIGN KEY (user_id) REFERENCES users (user_id)
+
+);*/
+
+type Assignment struct {
+
+	TopicId string `json:"topic"`
+
+	UserId int64 `json:"user_id"`
+
+	Name string `json:"name"`
+
+	Date time.Time `json:"date_assigned"`
+
+}
+
+// Topic id to assigned user ids.
+type allocation map[string][]int64
+
+type allocateRequest struct {
+
+	Overlap int `json:"overlap"`
+
+	Rebalance bool `json:"rebalance"`
+
+	Users []string `json:"users"`
+
+}
+
+type reassignRequest struct {
+
+	TopicId string `json:"topic"`
+
+	From string `json:"from"`
+
+	To string `json:"to"`
+
+}
+
+// Estimate of the number of documents a topic's pool will hold, used to
+// balance load between assessors. Each query pools at most PoolDepth
+// documents, overlap between queries is ignored.
+func (i *Instance) expectedPoolSize(topicId string) int {
+	if i.byList {
+		return len(i.docList[topicId])
+	}
+	t := i.topics[topicId]
+	queries := 1
+	for _, e := range t.Extracts {
+		queries += 2 + len(e.EsQuery)
+	}
+	return queries * i.config.Topics.PoolDepth
+}
+
+// allocateTopics assigns each topic to overlap distinct users, keeping the
+// assignments in fixed. Topics are taken largest first and given to the
+// least loaded users, ties broken by user id, so the result is deterministic.
+func allocateTopics(weights map[string]int, users []int64, overlap int, fixed allocation) (allocation, error) {
+	if overlap < 1 {
+		return nil, errors.New("Overlap must be at least 1")
+	}
+	if overlap > len(users) {
+		return nil, fmt.Errorf("Overlap of %d requires at least %d assessors, have %d", overlap, overlap, len(users))
+	}
+
+	load := map[int64]int{}
+	for _, u := range users {
+		load[u] = 0
+	}
+
+	res := allocation{}
+	for t, us := range fixed {
+		if _, ok := weights[t]; !ok {
+			continue
+		}
+		res[t] = append(res[t], us...)
+		for _, u := range us {
+			if _, ok := load[u]; ok {
+				load[u] += weights[t]
+			}
+		}
+	}
+
+	topics := make([]string, 0, len(weights))
+	for t := range weights {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(a, b int) bool {
+		if weights[topics[a]] != weights[topics[b]] {
+			return weights[topics[a]] > weights[topics[b]]
+		}
+		return topics[a] < topics[b]
+	})
+
+	for _, t := range topics {
+		assigned := map[int64]bool{}
+		for _, u := range res[t] {
+			assigned[u] = true
+		}
+
+		candidates := make([]int64, 0, len(users))
+		for _, u := range users {
+			if !assigned[u] {
+				candidates = append(candidates, u)
+			}
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			if load[candidates[a]] != load[candidates[b]] {
+				return load[candidates[a]] < load[candidates[b]]
+			}
+			return candidates[a] < candidates[b]
+		})
+
+		for j := 0; len(res[t]) < overlap && j < len(candidates); j++ {
+			res[t] = append(res[t], candidates[j])
+			load[candidates[j]] += weights[t]
+		}
+	}
+	return res, nil
+}
+
+// Allocates all loaded topics. Without rebalance existing assignments are kept
+// and only missing places are filled. With rebalance only assignments where
+// the assessor has already judged documents are kept and the rest are
+// redistributed. Assessments themselves are never touched.
+func (i *Instance) allocate(req allocateRequest) (allocation, error) {
+	overlap := req.Overlap
+	if overlap == 0 {
+		overlap = i.config.Topics.Overlap
+	}
+	if overlap == 0 {
+		overlap = 1
+	}
+
+	users, err := dbGetUsers(i.db)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	if len(req.Users) > 0 {
+		byName := map[string]int64{}
+		for _, u := range users {
+			byName[u.Name] = u.Id
+		}
+		for _, n := range req.Users {
+			id, ok := byName[strings.ToLower(n)]
+			if !ok {
+				return nil, fmt.Errorf("No such user %s", n)
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		for _, u := range users {
+			if u.Role == roleAssessor {
+				ids = append(ids, u.Id)
+			}
+		}
+	}
+
+	weights := map[string]int{}
+	for t := range i.topics {
+		weights[t] = i.expectedPoolSize(t)
+	}
+
+	current, err := dbGetAssignments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	fixed := allocation{}
+	if req.Rebalance {
+		started, err := dbGetAssessedTopicUsers(i.db)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range current {
+			if started[a.TopicId][a.UserId] {
+				fixed[a.TopicId] = append(fixed[a.TopicId], a.UserId)
+			}
+		}
+	} else {
+		for _, a := range current {
+			fixed[a.TopicId] = append(fixed[a.TopicId], a.UserId)
+		}
+	}
+
+	res, err := allocateTopics(weights, ids, overlap, fixed)
+	if err != nil {
+		return nil, err
+	}
+	return res, dbSaveAllocation(i.db, res, current, time.Now())
+}
+
+// Users who may see a topic, admins and observers see all topics.
+func (i *Instance) canViewTopic(userId int64, topicId string) (bool, error) {
+	role, err := dbGetUserRole(i.db, userId)
+	if err != nil {
+		return false, err
+	}
+	if role != roleAssessor {
+		return true, nil
+	}
+	assigned, err := dbGetUserAssignments(i.db, userId)
+	if err != nil {
+		return false, err
+	}
+	return assigned[topicId], nil
+}
+
+// Database ---------------------------------------------------------------------
+
+func dbGetAssignments(db *sql.DB) ([]Assignment, error) {
+	rows, err := db.Query("SELECT a.topic_id, a.user_id, u.name, a.date_assigned FROM assignment a JOIN users u ON u.user_id = a.user_id ORDER BY a.topic_id, a.user_id")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	assignments := make([]Assignment, 0)
+	for rows.Next() {
+		var a Assignment
+		err := rows.Scan(&a.TopicId, &a.UserId, &a.Name, &a.Date)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
+
+func dbGetUserAssignments(db *sql.DB, user int64) (map[string]bool, error) {
+	rows, err := db.Query("SELECT topic_id FROM assignment WHERE user_id = $1", user)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	topics := map[string]bool{}
+	for rows.Next() {
+		var topic_id string
+		err := rows.Scan(&topic_id)
+		if err != nil {
+			return nil, err
+		}
+		topics[topic_id] = true
+	}
+	return topics, rows.Err()
+}
+
+// Topic id to users who have judged at least one document for it.
+func dbGetAssessedTopicUsers(db *sql.DB) (map[string]map[int64]bool, error) {
+	rows, err := db.Query("SELECT DISTINCT topic_id, assessor FROM assessment")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	started := map[string]map[int64]bool{}
+	for rows.Next() {
+		var topic_id string
+		var assessor int64
+		err := rows.Scan(&topic_id, &assessor)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := started[topic_id]; !ok {
+			started[topic_id] = map[int64]bool{}
+		}
+		started[topic_id][assessor] = true
+	}
+	return started, rows.Err()
+}
+
+// Replaces current with a for the topics in a, leaving the date of unchanged
+// assignments as is.
+func dbSaveAllocation(db *sql.DB, a allocation, current []Assignment, date time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range current {
+		// Topics not being allocated, ie. not loaded, keep their assessors.
+		users, ok := a[c.TopicId]
+		if !ok {
+			continue
+		}
+		keep := false
+		for _, u := range users {
+			if u == c.UserId {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			_, err = tx.Exec("DELETE FROM assignment WHERE topic_id = $1 AND user_id = $2",
+				c.TopicId, c.UserId)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	for t, users := range a {
+		for _, u := range users {
+			_, err = tx.Exec("INSERT INTO assignment (topic_id, user_id, date_assigned) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+				t, u, date)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func dbReassignTopic(db *sql.DB, topicId, from, to string, date time.Time) (sql.Result, error) {
+	return db.Exec("UPDATE assignment SET user_id = (SELECT user_id FROM users WHERE name = $3), date_assigned = $4 WHERE topic_id = $1 AND user_id = (SELECT user_id FROM users WHERE name = $2)",
+		topicId, from, to, date)
+}
+
+// Handlers ---------------------------------------------------------------------
+
+func assignmentsHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	a, err := dbGetAssignments(i.db)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(a)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func apiAllocateTopics(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 500, err
+	}
+	var req allocateRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return 400, err
+	}
+
+	log.Printf("user %d - allocating topics, rebalance %t.\n", auth, req.Rebalance)
+	_, err = i.allocate(req)
+	if err != nil {
+		return 400, err
+	}
+	return assignmentsHandler(i, w, r)
+}
+
+func apiReassignTopic(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 500, err
+	}
+	var req reassignRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return 400, err
+	}
+
+	log.Printf("user %d - reassigning topic %s from %s to %s.\n", auth, req.TopicId, req.From, req.To)
+	res, err := dbReassignTopic(i.db, req.TopicId, strings.ToLower(req.From),
+		strings.ToLower(req.To), time.Now())
+	if err != nil {
+		return 400, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 404, fmt.Errorf("Topic %s is not assigned to %s", req.TopicId, req.From)
+	}
+	return assignmentsHandler(i, w, r)
+}
+
+// Commands ---------------------------------------------------------------------
+
+func allocateCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("allocate", flag.ExitOnError)
+	overlap := fs.Int("overlap", 0, "Assessors per topic [if 0 then topics.overlap from config]")
+	rebalance := fs.Bool("rebalance", false, "Redistribute assignments that have no assessments yet")
+	users := fs.String("users", "", "Comma separated assessors [if empty then all assessors]")
+	fs.Parse(args)
+
+	req := allocateRequest{Overlap: *overlap, Rebalance: *rebalance}
+	if *users != "" {
+		req.Users = strings.Split(*users, ",")
+	}
+	a, err := i.allocate(req)
+	if err != nil {
+		return err
+	}
+
+	topics := make([]string, 0, len(a))
+	for t := range a {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	for _, t := range topics {
+		fmt.Printf("%s\t%d\t%v\n", t, i.expectedPoolSize(t), a[t])
+	}
+	return nil
+}
+
+func reassignCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("reassign", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 3 {
+		return errors.New("usage: reassign <topic> <from> <to>")
+	}
+	res, err := dbReassignTopic(i.db, fs.Arg(0), strings.ToLower(fs.Arg(1)),
+		strings.ToLower(fs.Arg(2)), time.Now())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("Topic %s is not assigned to %s", fs.Arg(0), fs.Arg(1))
+	}
+	fmt.Printf("topic %s reassigned from %s to %s.\n", fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	return nil
+}
@@ -4,10 +4,14 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type Assessment struct {
@@ -60,25 +64,106 @@ func apiAssessTopic(i *Instance, w http.ResponseWriter, r *http.Request) (int, e
 		return 400, err
 	}
 
+	topicId := strconv.FormatInt(res.Id, 10)
+	ok, err := i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
 	date := time.Now()
 
+	assessments := make([]Assessment, len(res.Assessments))
 	for j := range res.Assessments {
-		dbSaveTopicAssessment(i.db, Assessment{
+		assessments[j] = Assessment{
 			TopicId: res.Id,
 			DocId: res.Assessments[j].Id,
 			UserId: auth,
 			Relevance: res.Assessments[j].Relevance,
 			Date: date,
-		})
+		}
+	}
+
+	err = dbSaveTopicAssessments(i.db, assessments)
+	if err != nil {
+		return 500, err
+	}
+	log.Printf("user %d - saved %d assessments for topic %d.\n", auth, len(assessments), res.Id)
+
+	if i.config.Topics.ActiveLearning {
+		i.retrainRanker(strconv.FormatInt(res.Id, 10))
 	}
 	return 200, nil
 }
 
-func dbSaveTopicAssessment(db *sql.DB, a Assessment) (sql.Result, error) {
-	return db.Exec("INSERT INTO assessment (doc_id, topic_id, assessor, relevant, date_assessed) VALUES ($1, $2, $3, $4, $5)",
+// The assessment table holds the current judgment for each (topic, doc,
+// assessor), every judgment is also appended to assessment_history.
+func dbSaveTopicAssessments(db *sql.DB, a []Assessment) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for j := range a {
+		_, err = dbSaveTopicAssessment(tx, a[j])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func dbSaveTopicAssessment(tx *sql.Tx, a Assessment) (sql.Result, error) {
+	_, err := tx.Exec("INSERT INTO assessment_history (doc_id, topic_id, assessor, relevant, date_assessed) VALUES ($1, $2, $3, $4, $5)",
+		a.DocId, a.TopicId, a.UserId, a.Relevance, a.Date)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Exec("INSERT INTO assessment (doc_id, topic_id, assessor, relevant, date_assessed) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (topic_id, doc_id, assessor) DO UPDATE SET relevant = EXCLUDED.relevant, date_assessed = EXCLUDED.date_assessed",
 		a.DocId, a.TopicId, a.UserId, a.Relevance, a.Date)
 }
 
+// Every judgment made for a topic, oldest first.
+func dbGetAssessmentHistory(db *sql.DB, topicId string) ([]Assessment, error) {
+	rows, err := db.Query("SELECT topic_id, doc_id, assessor, relevant, date_assessed FROM assessment_history WHERE topic_id = $1 ORDER BY date_assessed, history_id",
+		topicId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	history := make([]Assessment, 0)
+	for rows.Next() {
+		var a Assessment
+		err = rows.Scan(&a.TopicId, &a.DocId, &a.UserId, &a.Relevance, &a.Date)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, a)
+	}
+	return history, rows.Err()
+}
+
+func assessmentHistoryHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	vars := mux.Vars(r)
+	topicId, ok := vars["topicId"]; if !ok {
+		return 400, nil
+	}
+
+	history, err := dbGetAssessmentHistory(i.db, topicId)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(history)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
 func dbGetNumberAssessedPerTopic(db *sql.DB, user int64) (map[string]int, error) {
 	rows, err := db.Query("SELECT topic_id, COUNT(DISTINCT doc_id) FROM assessment WHERE assessor = $1 GROUP BY topic_id", user)
 	if err != nil {
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func (i *Instance) authed(r *http.Request) (int64, error) {
@@ -18,23 +24,146 @@ func (i *Instance) authed(r *http.Request) (int64, error) {
 	return val.(int64), nil
 }
 
+// Passwords are stored as bcrypt hashes. Rows created before hashing was
+// introduced still hold the plaintext password, these are recognised by the
+// missing hash prefix and are rehashed on the first successful login.
+func isPasswordHash(pass string) bool {
+	return strings.HasPrefix(pass, "$2a$") || strings.HasPrefix(pass, "$2b$") ||
+		strings.HasPrefix(pass, "$2y$")
+}
+
+func hashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Returns the user id if the name and password match, -1 otherwise.
 func dbGetUserId(db *sql.DB, name, pass string) (int64, error) {
-	var rows *sql.Rows
-	var err error
-	rows, err = db.Query("SELECT user_id FROM users WHERE name = $1 AND pass = $2",
-		name, pass)
+	var user_id int64
+	var stored string
+	err := db.QueryRow("SELECT user_id, pass FROM users WHERE name = $1",
+		name).Scan(&user_id, &stored)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	defer rows.Close()
-	for rows.Next() {
-		var user_id int64
-		err := rows.Scan(&user_id)
+	if isPasswordHash(stored) {
+		err = bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return -1, nil
+		}
 		if err != nil {
 			return 0, err
 		}
 		return user_id, nil
 	}
-	return -1, nil
+
+	// Legacy plaintext row - migrate once verified.
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) != 1 {
+		return -1, nil
+	}
+	_, err = dbSetUserPassword(db, name, pass)
+	if err != nil {
+		return 0, err
+	}
+	return user_id, nil
+}
+
+// Roles ----------------------------------------------------------------------
+
+const (
+	roleAdmin string = "admin"
+	roleAssessor string = "assessor"
+	roleObserver string = "observer"
+	roleAdjudicator string = "adjudicator"
+)
+
+var (
+	// Any logged in user.
+	anyRole = []string{roleAdmin, roleAssessor, roleObserver, roleAdjudicator}
+
+	// Users who may write assessments, tags and queries.
+	writeRoles = []string{roleAdmin, roleAssessor}
+
+	adminRoles = []string{roleAdmin}
+
+	// Users who may record final labels for disagreements.
+	adjudicateRoles = []string{roleAdmin, roleAdjudicator}
+)
+
+func validRole(role string) bool {
+	return hasRole(role, anyRole)
+}
+
+func hasRole(role string, roles []string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles are read on every request, not kept in the session, so a role change
+// or deletion applies at once. Empty if the user no longer exists.
+func dbGetUserRole(db *sql.DB, userId int64) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE user_id = $1", userId).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// roleHandler restricts a handler to the given roles. Unauthenticated page
+// requests are redirected to the login page, api requests receive a 401.
+type roleHandler struct {
+
+	handler
+
+	roles []string
+
+}
+
+func (i *Instance) allow(h func(*Instance, http.ResponseWriter, *http.Request) (int, error), roles ...string) roleHandler {
+	return roleHandler{handler{i, h}, roles}
+}
+
+func (h roleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth, err := h.authed(r)
+	if err != nil {
+		h.handler.error(w, 500, err)
+		return
+	}
+	if auth < 0 {
+		if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/login", 302)
+			return
+		}
+		h.handler.error(w, 401, errors.New("Unauthorized"))
+		return
+	}
+
+	role, err := dbGetUserRole(h.db, auth)
+	if err != nil {
+		h.handler.error(w, 500, err)
+		return
+	}
+	if role == "" {
+		h.handler.error(w, 401, errors.New("Unauthorized"))
+		return
+	}
+	for _, allowed := range h.roles {
+		if role == allowed {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	h.handler.error(w, 403, fmt.Errorf("user %d - role %q forbidden for %s", auth, role, r.URL.Path))
 }
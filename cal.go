@@ -0,0 +1,475 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// With topics.active_learning set, unjudged pool documents are shown most
+// likely relevant first (continuous active learning). A logistic regression
+// classifier over TF-IDF features of each decision's plain text is trained
+// per topic on every assessor's judgments, retrained in the background after
+// each batch posted to /assess, one training of a topic at a time. As in
+// Cormack and Grossman's BMI the topic text is added as a relevant document
+// and a sample of unjudged pool documents as non-relevant, so a topic can be
+// ranked before anything is judged.
+const (
+	// Unjudged documents presumed non-relevant when training.
+	calPresumed = 100
+
+	calEpochs = 20
+
+	calRate = 0.1
+
+	// L2 regularisation.
+	calLambda = 0.0001
+)
+
+type calModel struct {
+
+	idf map[string]float64
+
+	weights map[string]float64
+
+	bias float64
+
+}
+
+// Models per topic and the term frequencies of each decision seen, which
+// don't change between trainings.
+type calRanker struct {
+
+	sync.Mutex
+
+	features map[string]map[string]float64
+
+	models map[string]*calModel
+
+	// Held while a topic's model is trained or read, so a model trained on
+	// older judgments never replaces a newer one.
+	locks map[string]*sync.Mutex
+
+	// Topics retraining in the background, closed once done, and those
+	// judged again meanwhile.
+	retraining map[string]chan struct{}
+
+	pending map[string]bool
+
+}
+
+func newCalRanker() *calRanker {
+	return &calRanker{
+		features: map[string]map[string]float64{},
+		models: map[string]*calModel{},
+		locks: map[string]*sync.Mutex{},
+		retraining: map[string]chan struct{}{},
+		pending: map[string]bool{},
+	}
+}
+
+func (r *calRanker) topicLock(topicId string) *sync.Mutex {
+	r.Lock()
+	defer r.Unlock()
+	l, ok := r.locks[topicId]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[topicId] = l
+	}
+	return l
+}
+
+// Log term frequencies of the text's lower cased words.
+func termFeatures(text []rune) map[string]float64 {
+	tf := map[string]float64{}
+	for _, t := range textTokens(text) {
+		tf[strings.ToLower(string(text[t[0]:t[1]]))]++
+	}
+	for term, n := range tf {
+		tf[term] = 1 + math.Log(n)
+	}
+	return tf
+}
+
+// Term features of the documents, fetching those not seen before.
+func (i *Instance) calFeatures(ids []string) (map[string]map[string]float64, error) {
+	i.ranker.Lock()
+	missing := []string{}
+	res := map[string]map[string]float64{}
+	for _, id := range ids {
+		if f, ok := i.ranker.features[id]; ok {
+			res[id] = f
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	i.ranker.Unlock()
+
+	for start := 0; start < len(missing); start += 100 {
+		end := start + 100
+		if end > len(missing) {
+			end = len(missing)
+		}
+		docs, err := i.docs.MultiGet(missing[start:end])
+		if err != nil {
+			return nil, err
+		}
+		i.ranker.Lock()
+		for _, d := range docs {
+			f := termFeatures(newDocText(d.Html).text)
+			i.ranker.features[d.Id] = f
+			res[d.Id] = f
+		}
+		i.ranker.Unlock()
+	}
+	return res, nil
+}
+
+// TF-IDF vector, normalised to unit length.
+func (m *calModel) vector(tf map[string]float64) map[string]float64 {
+	v := map[string]float64{}
+	norm := 0.0
+	for term, f := range tf {
+		if idf, ok := m.idf[term]; ok {
+			v[term] = f * idf
+			norm += v[term] * v[term]
+		}
+	}
+	norm = math.Sqrt(norm)
+	for term := range v {
+		v[term] /= norm
+	}
+	return v
+}
+
+// Probability the document is relevant.
+func (m *calModel) score(tf map[string]float64) float64 {
+	z := m.bias
+	for term, x := range m.vector(tf) {
+		z += m.weights[term] * x
+	}
+	return 1 / (1 + math.Exp(-z))
+}
+
+// Trains a model on examples by stochastic gradient descent, in an order
+// seeded by the topic so the same judgments give the same model.
+func trainCalModel(idf map[string]float64, examples []map[string]float64, labels []bool, seed int64) *calModel {
+	m := &calModel{idf: idf, weights: map[string]float64{}}
+	vectors := make([]map[string]float64, len(examples))
+	for j, tf := range examples {
+		vectors[j] = m.vector(tf)
+	}
+
+	order := make([]int, len(examples))
+	for j := range order {
+		order[j] = j
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	for epoch := 0; epoch < calEpochs; epoch++ {
+		rnd.Shuffle(len(order), func(a, b int) { order[a], order[b] = order[b], order[a] })
+		for _, j := range order {
+			z := m.bias
+			for term, x := range vectors[j] {
+				z += m.weights[term] * x
+			}
+			y := 0.0
+			if labels[j] {
+				y = 1
+			}
+			g := 1 / (1 + math.Exp(-z)) - y
+			m.bias -= calRate * g
+			for term, x := range vectors[j] {
+				m.weights[term] -= calRate * (g * x + calLambda * m.weights[term])
+			}
+		}
+	}
+	return m
+}
+
+// Documents in the topic's shared pool.
+func (i *Instance) calPoolIds(topicId string) ([]string, error) {
+	if i.byList {
+		return i.docList[topicId], nil
+	}
+	topic, err := strconv.ParseInt(topicId, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := dbGetPoolSources(i.db, topic, 0)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	ids := []string{}
+	for _, s := range sources {
+		for _, id := range s.Docs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// Trains the topic's model on its current judgments and keeps it, the caller
+// holds the topic's lock.
+func (i *Instance) trainRanker(topicId string) (*calModel, error) {
+	topic, err := strconv.ParseInt(topicId, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	assessments, err := dbGetTopicAssessments(i.db, topic)
+	if err != nil {
+		return nil, err
+	}
+	poolIds, err := i.calPoolIds(topicId)
+	if err != nil {
+		return nil, err
+	}
+
+	// A document is relevant if most of its assessors judged it above the
+	// lowest grade, ties are relevant.
+	labels, _ := i.gradeLabels()
+	grades := i.grades()
+	votes := map[string]int{}
+	judgedIds := []string{}
+	for _, a := range assessments {
+		id := strconv.FormatInt(a.DocId, 10)
+		if _, ok := votes[id]; !ok {
+			judgedIds = append(judgedIds, id)
+		}
+		if grades[a.Relevance] > grades[labels[0]] {
+			votes[id]++
+		} else {
+			votes[id]--
+		}
+	}
+
+	unjudged := []string{}
+	for _, id := range poolIds {
+		if _, ok := votes[id]; !ok {
+			unjudged = append(unjudged, id)
+		}
+	}
+	sort.Strings(unjudged)
+	rnd := rand.New(rand.NewSource(topicSeed(topicId)))
+	rnd.Shuffle(len(unjudged), func(a, b int) { unjudged[a], unjudged[b] = unjudged[b], unjudged[a] })
+	if len(unjudged) > calPresumed {
+		unjudged = unjudged[:calPresumed]
+	}
+
+	features, err := i.calFeatures(append(append([]string{}, poolIds...), judgedIds...))
+	if err != nil {
+		return nil, err
+	}
+
+	// Document frequencies over the pool and judged documents.
+	df := map[string]int{}
+	for _, tf := range features {
+		for term := range tf {
+			df[term]++
+		}
+	}
+	idf := map[string]float64{}
+	for term, n := range df {
+		idf[term] = math.Log(float64(len(features) + 1) / float64(n))
+	}
+
+	examples := []map[string]float64{termFeatures([]rune(i.getTopic(topicId).Topic))}
+	relevant := []bool{true}
+	for _, id := range judgedIds {
+		if tf, ok := features[id]; ok {
+			examples = append(examples, tf)
+			relevant = append(relevant, votes[id] >= 0)
+		}
+	}
+	for _, id := range unjudged {
+		if tf, ok := features[id]; ok {
+			examples = append(examples, tf)
+			relevant = append(relevant, false)
+		}
+	}
+
+	m := trainCalModel(idf, examples, relevant, topicSeed(topicId))
+	i.ranker.Lock()
+	i.ranker.models[topicId] = m
+	i.ranker.Unlock()
+	log.Printf("trained ranker for topic %s on %d judged documents.\n", topicId, len(judgedIds))
+	return m, nil
+}
+
+// The topic's model, trained if there isn't one yet. Waits for a retraining
+// in progress.
+func (i *Instance) calModel(topicId string) (*calModel, error) {
+	i.ranker.Lock()
+	done, retraining := i.ranker.retraining[topicId]
+	i.ranker.Unlock()
+	if retraining {
+		<-done
+	}
+
+	lock := i.ranker.topicLock(topicId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	i.ranker.Lock()
+	m, ok := i.ranker.models[topicId]
+	i.ranker.Unlock()
+	if ok {
+		return m, nil
+	}
+	return i.trainRanker(topicId)
+}
+
+// Retrains the topic's model after new judgments without making the assessor
+// wait. Judgments posted while it trains are trained on straight after.
+func (i *Instance) retrainRanker(topicId string) {
+	r := i.ranker
+	r.Lock()
+	if _, ok := r.retraining[topicId]; ok {
+		r.pending[topicId] = true
+		r.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	r.retraining[topicId] = done
+	r.Unlock()
+
+	// Locked in the background, the request would otherwise wait out a
+	// training already under way in calModel.
+	go func() {
+		defer close(done)
+		lock := r.topicLock(topicId)
+		lock.Lock()
+		defer lock.Unlock()
+		for {
+			// The judgments are saved, a failed retraining only leaves the
+			// previous ranking.
+			_, err := i.trainRanker(topicId)
+			if err != nil {
+				log.Println(err)
+			}
+			r.Lock()
+			if !r.pending[topicId] {
+				delete(r.retraining, topicId)
+				r.Unlock()
+				return
+			}
+			delete(r.pending, topicId)
+			r.Unlock()
+		}
+	}()
+}
+
+// Probability of relevance of each document under the topic's model.
+func (i *Instance) calScores(topicId string, ids []string) (map[string]float64, error) {
+	m, err := i.calModel(topicId)
+	if err != nil {
+		return nil, err
+	}
+	features, err := i.calFeatures(ids)
+	if err != nil {
+		return nil, err
+	}
+	scores := map[string]float64{}
+	for id, tf := range features {
+		scores[id] = m.score(tf)
+	}
+	return scores, nil
+}
+
+// Orders hits the user hasn't judged by their probability of relevance, most
+// likely first and ties in pool order, followed by those they have judged in
+// pool order.
+func (i *Instance) rankUnjudged(topicId string, hits []ApiCaseResponse) ([]ApiCaseResponse, error) {
+	unjudged := []ApiCaseResponse{}
+	judged := []ApiCaseResponse{}
+	ids := []string{}
+	for _, h := range hits {
+		if h.Relevance == "" {
+			unjudged = append(unjudged, h)
+			ids = append(ids, h.Id)
+		} else {
+			judged = append(judged, h)
+		}
+	}
+	scores, err := i.calScores(topicId, ids)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(unjudged, func(a, b int) bool {
+		return scores[unjudged[a].Id] > scores[unjudged[b].Id]
+	})
+	return append(unjudged, judged...), nil
+}
+
+func dbGetTopicAssessments(db *sql.DB, topic int64) ([]Assessment, error) {
+	rows, err := db.Query(`SELECT topic_id, doc_id, assessor, relevant, date_assessed FROM assessment
+		WHERE topic_id = $1 AND relevant IS NOT NULL ORDER BY doc_id, assessor`, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	assessments := make([]Assessment, 0)
+	for rows.Next() {
+		var a Assessment
+		err = rows.Scan(&a.TopicId, &a.DocId, &a.UserId, &a.Relevance, &a.Date)
+		if err != nil {
+			return nil, err
+		}
+		assessments = append(assessments, a)
+	}
+	return assessments, rows.Err()
+}
+
+// GET /data/{topicId}/ranking - ids of the user's unjudged pool documents,
+// most likely relevant first. Empty unless topics.active_learning is set.
+func topicRankingHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	if auth < 0 {
+		return 401, errors.New("Unauthorized")
+	}
+	topicId := mux.Vars(r)["topicId"]
+	ok, err := i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
+	ids := []string{}
+	if i.config.Topics.ActiveLearning {
+		_, hits, err := i.topicHits(auth, topicId, true)
+		if err != nil {
+			return 500, err
+		}
+		for _, h := range hits {
+			if h.Relevance == "" {
+				ids = append(ids, h.Id)
+			}
+		}
+	}
+	buff, err := json.Marshal(ids)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Subcommands run against the configured database instead of starting the
+// server, ie. `server useradd alice`. Topics are only loaded for commands
+// that need them.
+type command struct {
+
+	Usage string
+
+	Topics bool
+
+	Run func(*Instance, []string) error
+
+}
+
+var commands = map[string]command{
+	"useradd": {"useradd [-role role] <name> - add a user, reading the password from stdin", false, userAddCommand},
+	"passwd": {"passwd <name> - change a user's password", false, passwdCommand},
+	"role": {"role <name> <admin|assessor|observer|adjudicator> - change a user's role", false, userRoleCommand},
+	"userdel": {"userdel <name> - remove a user", false, userDelCommand},
+	"list": {"list - list users", false, userListCommand},
+	"allocate": {"allocate [-overlap n] [-rebalance] [-users a,b] - allocate topics to assessors", true, allocateCommand},
+	"reassign": {"reassign <topic> <from> <to> - move a topic between assessors", false, reassignCommand},
+	"evaluate": {"evaluate [-depth k] [-topics 1,2] [-adjudicated] [-q] [-json] run... - evaluate TREC run files against the judgments", false, evaluateCommand},
+	"export-passages": {"export-passages [-format jsonl|trec] [-topics 1,2] [-categories a,b] [-assessor name] [-o path] - write tags as passage judgments", false, exportPassagesCommand},
+	"rebuild-pools": {"rebuild-pools [-topics 1,2] - search topic queries and saved searches again after the index changes", true, rebuildPoolsCommand},
+	"import-runs": {"import-runs [-depth n] [-topics 1,2] run... - add TREC run files to topic pools", true, importRunsCommand},
+	"reanchor-tags": {"reanchor-tags [-legacy] - find tags again in re-indexed decisions", false, reanchorTagsCommand},
+	"export-qrels": {"export-qrels [-topics 1,2] [-consolidate majority|none] [-adjudicated] [-assessor name] [-per-assessor] [-o path] - write TREC qrels", false, exportQrelsCommand},
+}
+
+func runCommand(i *Instance, args []string, loadTopic, updateTopics bool) error {
+	c, ok := commands[args[0]]
+	if !ok {
+		printCommands()
+		return fmt.Errorf("Unknown command %s", args[0])
+	}
+	if c.Topics {
+		err := i.initTopics(loadTopic, updateTopics)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Run(i, args[1:])
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, k := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[k].Usage)
+	}
+}
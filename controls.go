@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/* Control documents are described in the database as follows:
+
+CREATE TABLE control (
+
+	topic_id bigint NOT NULL,
+
+	doc_id bigint NOT NULL,
+
+	date_added TIMESTAMP,
+
+	PRIMARY KEY (topic_id, doc_id)
+
+);*/
+
+// Cases the topic decision cites (Extract.CitedId) are known to be relevant.
+// With topics.control_fraction set, some that the topic's queries didn't
+// retrieve are added to its pool so each assessor's grading of them can be
+// checked. The set is chosen once per topic and kept in the control table,
+// and control documents are listed and scored like any other pool document,
+// though not counted as pooled by any query.
+func (t Topic) citedIds() []int64 {
+	seen := map[int64]bool{}
+	ids := []int64{}
+	for _, e := range t.Extracts {
+		for _, id := range e.CitedId {
+			if !seen[int64(id)] {
+				seen[int64(id)] = true
+				ids = append(ids, int64(id))
+			}
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	return ids
+}
+
+// Seeds random choices for a topic, so they are the same on every load.
+func topicSeed(topicId string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(topicId))
+	return int64(h.Sum64())
+}
+
+// Adds the topic's control documents that aren't already in the pool.
+func (i *Instance) addControls(userId int64, topicId string, hits []ApiCaseResponse) ([]ApiCaseResponse, error) {
+	if i.config.Topics.ControlFraction <= 0 || len(hits) == 0 {
+		return hits, nil
+	}
+	topic, err := strconv.ParseInt(topicId, 10, 64)
+	if err != nil {
+		return hits, nil
+	}
+
+	pooled := map[string]bool{}
+	for _, h := range hits {
+		pooled[h.Id] = true
+	}
+
+	controls, err := dbGetControls(i.db, topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(controls) == 0 {
+		controls, err = i.chooseControls(topic, topicId, pooled, len(hits))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids := []string{}
+	for _, id := range controls {
+		if s := strconv.FormatInt(id, 10); !pooled[s] {
+			ids = append(ids, s)
+		}
+	}
+	if len(ids) == 0 {
+		return hits, nil
+	}
+	res, err := i.elasticIdsQuery(userId, topicId, ids)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res.Results, func(a, b int) bool { return res.Results[a].Id < res.Results[b].Id })
+
+	rnd := rand.New(rand.NewSource(topicSeed(topicId)))
+	for _, c := range res.Results {
+		// Placed after a random pool document, with a score between its
+		// neighbours', or below the last by up to the gap before it.
+		at := rnd.Intn(len(hits)) + 1
+		hi := hits[at - 1].Score
+		lo := hi
+		if at < len(hits) {
+			lo = hits[at].Score
+		} else if at > 1 {
+			lo = hi - math.Abs(hits[at - 2].Score - hi)
+		}
+		c.Score = lo + rnd.Float64() * (hi - lo)
+		hits = append(hits, ApiCaseResponse{})
+		copy(hits[at + 1:], hits[at:])
+		hits[at] = c
+	}
+	return hits, nil
+}
+
+// Picks control_fraction of the pool size from the cited documents not in the
+// pool, at least one if there are any.
+func (i *Instance) chooseControls(topic int64, topicId string, pooled map[string]bool, poolSize int) ([]int64, error) {
+	candidates := []int64{}
+	for _, id := range i.getTopic(topicId).citedIds() {
+		if !pooled[strconv.FormatInt(id, 10)] {
+			candidates = append(candidates, id)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	n := int(math.Ceil(i.config.Topics.ControlFraction * float64(poolSize)))
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	rnd := rand.New(rand.NewSource(topicSeed(topicId)))
+	rnd.Shuffle(len(candidates), func(a, b int) {
+		candidates[a], candidates[b] = candidates[b], candidates[a]
+	})
+	chosen := candidates[:n]
+	err := dbSaveControls(i.db, topic, chosen)
+	if err != nil {
+		return nil, err
+	}
+	return chosen, nil
+}
+
+func dbGetControls(db *sql.DB, topic int64) ([]int64, error) {
+	rows, err := db.Query("SELECT doc_id FROM control WHERE topic_id = $1 ORDER BY doc_id", topic)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func dbSaveControls(db *sql.DB, topic int64, ids []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids {
+		_, err = tx.Exec("INSERT INTO control (topic_id, doc_id, date_added) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+			topic, id, now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Control report ----------------------------------------------------------------
+
+type ControlJudgment struct {
+
+	TopicId int64 `json:"topic"`
+
+	DocId int64 `json:"doc"`
+
+	Relevance string `json:"relevance"`
+
+}
+
+type AssessorControls struct {
+
+	Assessor string `json:"assessor"`
+
+	// Control documents the assessor judged.
+	Judged int `json:"judged"`
+
+	// Judgments per grade label.
+	Grades map[string]int `json:"grades"`
+
+	MeanGrade stat `json:"mean_grade"`
+
+	// Share of controls judged anything above the lowest grade.
+	Relevant stat `json:"relevant"`
+
+	Judgments []ControlJudgment `json:"judgments"`
+
+}
+
+type ControlReport struct {
+
+	// Grade labels in order.
+	Labels []string `json:"labels"`
+
+	// Control documents per topic.
+	Controls map[string]int `json:"controls"`
+
+	Assessors []AssessorControls `json:"assessors"`
+
+}
+
+func (i *Instance) controlReport() (*ControlReport, error) {
+	controls, err := dbGetAllControls(i.db)
+	if err != nil {
+		return nil, err
+	}
+	assessments, err := dbGetAssessments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	users, err := dbGetUsers(i.db)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int64]string{}
+	for _, u := range users {
+		names[u.Id] = u.Name
+	}
+	labels, _ := i.gradeLabels()
+	grades := i.grades()
+	lowest := grades[labels[0]]
+
+	report := &ControlReport{Labels: labels, Controls: map[string]int{}, Assessors: []AssessorControls{}}
+	for k := range controls {
+		report.Controls[strconv.FormatInt(k[0], 10)]++
+	}
+
+	byUser := map[int64]*AssessorControls{}
+	sums := map[int64]int{}
+	relevant := map[int64]int{}
+	for _, a := range assessments {
+		if !controls[[2]int64{a.TopicId, a.DocId}] {
+			continue
+		}
+		c, ok := byUser[a.UserId]
+		if !ok {
+			c = &AssessorControls{Assessor: names[a.UserId], Grades: map[string]int{}, Judgments: []ControlJudgment{}}
+			byUser[a.UserId] = c
+		}
+		c.Judged++
+		c.Grades[a.Relevance]++
+		c.Judgments = append(c.Judgments, ControlJudgment{a.TopicId, a.DocId, a.Relevance})
+		sums[a.UserId] += grades[a.Relevance]
+		if grades[a.Relevance] > lowest {
+			relevant[a.UserId]++
+		}
+	}
+	for u, c := range byUser {
+		c.MeanGrade = stat(float64(sums[u]) / float64(c.Judged))
+		c.Relevant = ratio(relevant[u], c.Judged)
+		sort.Slice(c.Judgments, func(a, b int) bool {
+			if c.Judgments[a].TopicId != c.Judgments[b].TopicId {
+				return c.Judgments[a].TopicId < c.Judgments[b].TopicId
+			}
+			return c.Judgments[a].DocId < c.Judgments[b].DocId
+		})
+		report.Assessors = append(report.Assessors, *c)
+	}
+	sort.Slice(report.Assessors, func(a, b int) bool {
+		return report.Assessors[a].Assessor < report.Assessors[b].Assessor
+	})
+	return report, nil
+}
+
+func dbGetAllControls(db *sql.DB) (map[[2]int64]bool, error) {
+	rows, err := db.Query("SELECT topic_id, doc_id FROM control")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	controls := map[[2]int64]bool{}
+	for rows.Next() {
+		var k [2]int64
+		err = rows.Scan(&k[0], &k[1])
+		if err != nil {
+			return nil, err
+		}
+		controls[k] = true
+	}
+	return controls, rows.Err()
+}
+
+// GET /admin/controls
+func controlReportHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	report, err := i.controlReport()
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(report)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
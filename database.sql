@@ -1,13 +1,17 @@
+CREATE TYPE userRole AS ENUM('admin', 'assessor', 'observer', 'adjudicator');
 
 CREATE TABLE users (
 
 	user_id SERIAL UNIQUE,
 
-	name VARCHAR(255) NOT NULL,
+	name VARCHAR(255) NOT NULL UNIQUE,
 
-	pass VARCHAR(20) NOT NULL,
+	-- bcrypt hash, see auth.go
+	pass VARCHAR(255) NOT NULL,
 
-	PRIMARY KEY (name, pass)
+	role userRole NOT NULL DEFAULT 'assessor',
+
+	PRIMARY KEY (user_id)
 
 );
 
@@ -25,25 +29,64 @@ CREATE TABLE tag (
 
 	date_added TIMESTAMP,
 
-	start_pos bigint NOT NULL,
+	-- Character offsets into the decision's plain text, see doctext.go.
+	start_char bigint NOT NULL,
 
-	end_pos bigint NOT NULL,
+	end_char bigint NOT NULL,
 
-	start_offset bigint NOT NULL,
+	quote TEXT NOT NULL,
 
-	end_offset bigint NOT NULL,
+	-- One of tags.categories in config.json.
+	category VARCHAR(255) NOT NULL DEFAULT '',
 
-	start_container VARCHAR NOT NULL,
+	note TEXT NOT NULL DEFAULT '',
 
-	end_container VARCHAR NOT NULL,
+	-- Optional grade for the span itself.
+	relevant assessType,
 
-	start_id INT NOT NULL,
+	-- Deleted tags are kept, hidden, so deletes can be undone.
+	deleted_at TIMESTAMP,
 
-	end_id INT NOT NULL,
+	deleted_by int,
 
 	PRIMARY KEY (topic_id, doc_id, tagger, date_added),
 
-	FOREIGN KEY (tagger) REFERENCES users (user_id)
+	FOREIGN KEY (tagger) REFERENCES users (user_id),
+
+	FOREIGN KEY (deleted_by) REFERENCES users (user_id)
+
+);
+
+-- Earlier versions of edited tags, tag holds the current one.
+CREATE TABLE tag_history (
+
+	history_id SERIAL,
+
+	tag_id int NOT NULL,
+
+	start_char bigint NOT NULL,
+
+	end_char bigint NOT NULL,
+
+	quote TEXT NOT NULL,
+
+	category VARCHAR(255) NOT NULL,
+
+	note TEXT NOT NULL,
+
+	relevant assessType,
+
+	-- When this version was replaced, and by whom, NULL when reanchor-tags
+	-- moved the tag.
+	date_replaced TIMESTAMP,
+
+	edited_by int,
+
+	PRIMARY KEY (history_id),
+
+	FOREIGN KEY (tag_id) REFERENCES tag (tag_id),
+
+	FOREIGN KEY (edited_by) REFERENCES users (user_id)
 
 );
 
@@ -63,10 +106,52 @@ CREATE TABLE assessment (
 
 	PRIMARY KEY (assessment_id),
 
+	UNIQUE (topic_id, doc_id, assessor),
+
+	FOREIGN KEY (assessor) REFERENCES users (user_id)
+
+);
+
+-- Append only record of every judgment, assessment holds the latest.
+CREATE TABLE assessment_history (
+
+	history_id SERIAL,
+
+	doc_id bigint NOT NULL,
+
+	topic_id bigint NOT NULL,
+
+	assessor int NOT NULL,
+
+	relevant assessType,
+
+	date_assessed TIMESTAMP,
+
+	PRIMARY KEY (history_id),
+
 	FOREIGN KEY (assessor) REFERENCES users (user_id)
 
 );
 
+-- Final labels for documents assessors disagree on, kept apart from assessment.
+CREATE TABLE adjudication (
+
+	topic_id bigint NOT NULL,
+
+	doc_id bigint NOT NULL,
+
+	adjudicator int NOT NULL,
+
+	relevant assessType NOT NULL,
+
+	date_adjudicated TIMESTAMP,
+
+	PRIMARY KEY (topic_id, doc_id),
+
+	FOREIGN KEY (adjudicator) REFERENCES users (user_id)
+
+);
+
 CREATE TABLE query (
 
 		query_id SERIAL,
@@ -77,6 +162,9 @@ CREATE TABLE query (
 
 		query text NOT NULL,
 
+		-- Fields the search was made on as a json list, NULL for the defaults.
+		fields text,
+
 		date_added TIMESTAMP,
 
 		PRIMARY KEY (query_id),
@@ -84,3 +172,160 @@ CREATE TABLE query (
 		FOREIGN KEY (user_id) REFERENCES users (user_id)
 
 );
+
+
+CREATE TABLE assignment (
+
+	topic_id bigint NOT NULL,
+
+	user_id int NOT NULL,
+
+	date_assigned TIMESTAMP,
+
+	PRIMARY KEY (topic_id, user_id),
+
+	FOREIGN KEY (user_id) REFERENCES users (user_id)
+
+);
+
+-- Known relevant documents added to a topic's pool to check assessors, see
+-- controls.go.
+CREATE TABLE control (
+
+	topic_id bigint NOT NULL,
+
+	doc_id bigint NOT NULL,
+
+	date_added TIMESTAMP,
+
+	PRIMARY KEY (topic_id, doc_id)
+
+);
+
+CREATE TABLE pool_source (
+
+	source_id SERIAL,
+
+	topic_id bigint NOT NULL,
+
+	-- 0 for the topic's own queries, shared by every assessor.
+	user_id int NOT NULL DEFAULT 0,
+
+	-- The assessor's search, if the source is one.
+	query_id int,
+
+	-- The imported run, if the source is one, see runs.go.
+	run VARCHAR(255),
+
+	query text NOT NULL,
+
+	total_hits int NOT NULL,
+
+	added_at TIMESTAMP,
+
+	PRIMARY KEY (source_id),
+
+	-- A search is pooled once.
+	UNIQUE (query_id)
+
+);
+
+CREATE TABLE pool (
+
+	source_id int NOT NULL,
+
+	topic_id bigint NOT NULL,
+
+	doc_id bigint NOT NULL,
+
+	rank int NOT NULL,
+
+	score double precision NOT NULL,
+
+	added_at TIMESTAMP,
+
+	PRIMARY KEY (source_id, doc_id),
+
+	FOREIGN KEY (source_id) REFERENCES pool_source (source_id) ON DELETE CASCADE
+
+);
+
+-- Migrating an existing database to hashed passwords. Plaintext passwords are
+-- rehashed on each user's next successful login.
+--
+-- ALTER TABLE users ALTER COLUMN pass TYPE VARCHAR(255);
+-- ALTER TABLE users DROP CONSTRAINT users_pkey;
+-- ALTER TABLE users ADD PRIMARY KEY (user_id);
+-- ALTER TABLE users ADD UNIQUE (name);
+
+-- Adding roles to an existing database.
+--
+-- CREATE TYPE userRole AS ENUM('admin', 'assessor', 'observer');
+-- ALTER TABLE users ADD COLUMN role userRole NOT NULL DEFAULT 'assessor';
+
+-- Moving an existing database to latest-wins assessments. All rows are kept in
+-- the history, only the latest per (topic, doc, assessor) stays current.
+--
+-- CREATE TABLE assessment_history (...);
+-- INSERT INTO assessment_history (doc_id, topic_id, assessor, relevant, date_assessed)
+-- 	SELECT doc_id, topic_id, assessor, relevant, date_assessed FROM assessment ORDER BY assessment_id;
+-- DELETE FROM assessment a USING assessment b WHERE a.topic_id = b.topic_id
+-- 	AND a.doc_id = b.doc_id AND a.assessor = b.assessor AND a.assessment_id < b.assessment_id;
+-- ALTER TABLE assessment ADD UNIQUE (topic_id, doc_id, assessor);
+
+-- Adding adjudication to an existing database.
+--
+-- ALTER TYPE userRole ADD VALUE 'adjudicator';
+-- CREATE TABLE adjudication (...);
+
+-- Moving tags from html positions to plain text offsets. reanchor-tags -legacy
+-- fills the new columns from start_pos and end_pos.
+--
+-- ALTER TABLE tag ADD COLUMN start_char bigint, ADD COLUMN end_char bigint, ADD COLUMN quote TEXT;
+-- ./caselaw-relevance reanchor-tags -legacy
+-- Tags reported as not converted keep their NULL quote and the constraints
+-- below fail until they are fixed by hand.
+-- ALTER TABLE tag ALTER COLUMN start_char SET NOT NULL, ALTER COLUMN end_char SET NOT NULL,
+-- 	ALTER COLUMN quote SET NOT NULL;
+-- ALTER TABLE tag DROP COLUMN start_pos, DROP COLUMN end_pos, DROP COLUMN start_offset,
+-- 	DROP COLUMN end_offset, DROP COLUMN start_container, DROP COLUMN end_container,
+-- 	DROP COLUMN start_id, DROP COLUMN end_id;
+
+-- Adding categories, notes and grades to tags, existing tags have no category.
+--
+-- ALTER TABLE tag ADD COLUMN category VARCHAR(255) NOT NULL DEFAULT '',
+-- 	ADD COLUMN note TEXT NOT NULL DEFAULT '', ADD COLUMN relevant assessType;
+
+-- Soft deletion of tags.
+--
+-- ALTER TABLE tag ADD COLUMN deleted_at TIMESTAMP,
+-- 	ADD COLUMN deleted_by int REFERENCES users (user_id);
+
+-- Adding tag editing to an existing database.
+--
+-- CREATE TABLE tag_history (...);
+
+-- Adding control documents to an existing database.
+--
+-- CREATE TABLE control (...);
+
+-- Adding persisted pools to an existing database. Pools are built from the
+-- topic queries and saved searches the next time each topic is loaded.
+--
+-- CREATE TABLE pool_source (...);
+-- CREATE TABLE pool (...);
+
+-- Adding imported runs to existing pools.
+--
+-- ALTER TABLE pool_source ADD COLUMN run VARCHAR(255);
+
+-- Pooling each search once, removing searches pooled twice.
+--
+-- DELETE FROM pool_source a USING pool_source b
+-- 	WHERE a.query_id = b.query_id AND a.source_id > b.source_id;
+-- ALTER TABLE pool_source ADD UNIQUE (query_id);
+
+-- Keeping the fields searches were made on, so they are pooled the same way.
+-- Searches saved before are pooled on the default fields.
+--
+-- ALTER TABLE query ADD COLUMN fields TEXT;
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tags are anchored to character (code point) offsets in the plain text of a
+// decision: the text content of its html as the browser renders it into the
+// topic page, with markup dropped, entities decoded and whitespace kept. This
+// stays the same whatever elements the page inserts around the text, and the
+// tagged text itself is kept so a tag can be found again if the decision is
+// re-indexed with different text.
+type docText struct {
+
+	text []rune
+
+	// Rune offset in the html of each character of text.
+	src []int
+
+}
+
+// Elements whose leading newline is dropped by the html parser.
+var dropLeadingNewline = map[string]bool{"pre": true, "textarea": true, "listing": true}
+
+func newDocText(h string) *docText {
+	in := []rune(h)
+	d := &docText{
+		text: make([]rune, 0, len(in)),
+		src: make([]int, 0, len(in)),
+	}
+	skipNewline := false
+	for j := 0; j < len(in); j++ {
+		c := in[j]
+		switch {
+			case c == '<' && j + 3 < len(in) && string(in[j:j + 4]) == "<!--":
+				end := strings.Index(string(in[j + 4:]), "-->")
+				if end < 0 {
+					return d
+				}
+				j += 4 + utf8.RuneCountInString(string(in[j + 4:])[:end]) + 2
+				continue
+			case c == '<' && j + 1 < len(in) && isTagStart(in[j + 1]):
+				k := j + 1
+				for k < len(in) && in[k] != '>' {
+					k++
+				}
+				name := strings.FieldsFunc(string(in[j + 1:k]), func(r rune) bool {
+					return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '/'
+				})
+				skipNewline = in[j + 1] != '/' && len(name) > 0 &&
+					dropLeadingNewline[strings.ToLower(name[0])]
+				j = k
+				continue
+			case c == '&':
+				if k := entityEnd(in, j); k > 0 {
+					for _, r := range html.UnescapeString(string(in[j:k])) {
+						d.add(r, j)
+					}
+					j = k - 1
+					skipNewline = false
+					continue
+				}
+			case c == '\r':
+				// Newlines are normalised when parsing.
+				if j + 1 < len(in) && in[j + 1] == '\n' {
+					j++
+				}
+				c = '\n'
+		}
+		if skipNewline && c == '\n' {
+			skipNewline = false
+			continue
+		}
+		skipNewline = false
+		d.add(c, j)
+	}
+	return d
+}
+
+func (d *docText) add(r rune, src int) {
+	d.text = append(d.text, r)
+	d.src = append(d.src, src)
+}
+
+func isTagStart(r rune) bool {
+	return r == '/' || r == '!' || r == '?' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// End of a character reference starting at j, or 0 if there isn't one.
+func entityEnd(in []rune, j int) int {
+	for k := j + 1; k < len(in) && k < j + 33; k++ {
+		if in[k] == ';' {
+			if k > j + 1 && html.UnescapeString(string(in[j:k + 1])) != string(in[j:k + 1]) {
+				return k + 1
+			}
+			return 0
+		}
+		if !(in[k] == '#' || (in[k] >= '0' && in[k] <= '9') ||
+			(in[k] >= 'a' && in[k] <= 'z') || (in[k] >= 'A' && in[k] <= 'Z')) {
+			return 0
+		}
+	}
+	return 0
+}
+
+func (d *docText) slice(start, end int) (string, bool) {
+	if start < 0 || end < start || end > len(d.text) {
+		return "", false
+	}
+	return string(d.text[start:end]), true
+}
+
+// Character offset of a rune offset in the html, the first character at or
+// after it.
+func (d *docText) fromHtml(pos int) int {
+	lo, hi := 0, len(d.src)
+	for lo < hi {
+		m := (lo + hi) / 2
+		if d.src[m] < pos {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo
+}
+
+// Rune offset in s of a UTF-16 code unit offset, as javascript indexes strings.
+func runeOffset(s string, pos int) int {
+	units, n := 0, 0
+	for _, r := range s {
+		if units >= pos {
+			break
+		}
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+		n++
+	}
+	return n
+}
+
+// Re-anchoring ------------------------------------------------------------------
+
+// Errors allowed when matching a quote, as a fraction of its length.
+const anchorErrorRate = 0.2
+
+// Quotes longer than twice this are matched by their first and last
+// anchorContext characters, keeping the search linear in the document length.
+const anchorContext = 32
+
+// Finds quote in the text, starting from start and end. Exact matches are
+// preferred, then the closest approximate match, and among equals the one
+// nearest start.
+func (d *docText) anchor(quote string, start, end int) (int, int, bool) {
+	if s, ok := d.slice(start, end); ok && s == quote {
+		return start, end, true
+	}
+	q := []rune(quote)
+	if len(q) == 0 {
+		return 0, 0, false
+	}
+
+	best := approxMatch{start: -1}
+	better := func(m approxMatch) {
+		if best.start < 0 || m.dist < best.dist ||
+			(m.dist == best.dist && abs(m.start - start) < abs(best.start - start)) {
+			best = m
+		}
+	}
+
+	text := string(d.text)
+	for k := strings.Index(text, quote); k >= 0; {
+		s := utf8.RuneCountInString(text[:k])
+		better(approxMatch{s, s + len(q), 0})
+		n := strings.Index(text[k + 1:], quote)
+		if n < 0 {
+			break
+		}
+		k += n + 1
+	}
+	if best.start >= 0 {
+		return best.start, best.end, true
+	}
+
+	maxDist := maxAnchorDist(len(q))
+	if len(q) <= 2 * anchorContext {
+		for _, m := range approxFind(d.text, q, maxDist) {
+			better(m)
+		}
+	} else {
+		heads := approxFind(d.text, q[:anchorContext], maxAnchorDist(anchorContext))
+		tails := approxFind(d.text, q[len(q) - anchorContext:], maxAnchorDist(anchorContext))
+		for _, h := range heads {
+			for _, t := range tails {
+				if t.start < h.end || abs(t.end - h.start - len(q)) > maxDist {
+					continue
+				}
+				better(approxMatch{h.start, t.end, h.dist + t.dist})
+			}
+		}
+	}
+	if best.start < 0 {
+		return 0, 0, false
+	}
+	return best.start, best.end, true
+}
+
+func maxAnchorDist(n int) int {
+	return int(float64(n) * anchorErrorRate)
+}
+
+type approxMatch struct {
+
+	start, end int
+
+	dist int
+
+}
+
+// Occurrences of pat in text within maxDist edits (Sellers' algorithm), the
+// closest of each run of overlapping matches.
+func approxFind(text, pat []rune, maxDist int) []approxMatch {
+	m := len(pat)
+	cost, start := make([]int, m + 1), make([]int, m + 1)
+	next, nextStart := make([]int, m + 1), make([]int, m + 1)
+	for j := range cost {
+		cost[j] = j
+	}
+
+	res := []approxMatch{}
+	inRun := false
+	for i := 1; i <= len(text); i++ {
+		next[0], nextStart[0] = 0, i
+		for j := 1; j <= m; j++ {
+			c, s := cost[j - 1], start[j - 1]
+			if text[i - 1] != pat[j - 1] {
+				c++
+			}
+			if next[j - 1] + 1 < c {
+				c, s = next[j - 1] + 1, nextStart[j - 1]
+			}
+			if cost[j] + 1 < c {
+				c, s = cost[j] + 1, start[j]
+			}
+			next[j], nextStart[j] = c, s
+		}
+		cost, next = next, cost
+		start, nextStart = nextStart, start
+
+		if cost[m] > maxDist {
+			inRun = false
+			continue
+		}
+		match := approxMatch{start[m], i, cost[m]}
+		if inRun && match.start < res[len(res) - 1].end {
+			if match.dist < res[len(res) - 1].dist {
+				res[len(res) - 1] = match
+			}
+			continue
+		}
+		res = append(res, match)
+		inRun = true
+	}
+	return res
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
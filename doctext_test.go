@@ -0,0 +1,164 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDocText(t *testing.T) {
+	tests := []struct {
+
+		html string
+
+		text string
+
+	}{
+		{"<p>a &amp; b</p>", "a & b"},
+		{"a & b &c d", "a & b &c d"},
+		{"&lt;i&gt; &#233;&#x41;", "<i> éA"},
+		{"a<!-- <b>x</b> -->b", "ab"},
+		{"a<!-- unclosed <b>b</b>", "a"},
+		{"<pre>\nx\n</pre>", "x\n"},
+		{"<p>\nx</p>", "\nx"},
+		{"a\r\nb\rc", "a\nb\nc"},
+		{"&#128512;<b>é</b>😀x", "😀é😀x"},
+		{"1 < 2 <br/>3", "1 < 2 3"},
+	}
+	for _, test := range tests {
+		d := newDocText(test.html)
+		if string(d.text) != test.text {
+			t.Errorf("%q: got %q, want %q", test.html, string(d.text), test.text)
+		}
+		if len(d.src) != len(d.text) {
+			t.Errorf("%q: %d offsets for %d characters", test.html, len(d.src), len(d.text))
+		}
+	}
+}
+
+func TestDocTextOffsets(t *testing.T) {
+	// Offsets are in runes of the html, entities map to their first rune.
+	d := newDocText("<p>😀 &amp; <i>b</i></p>")
+	if want := []int{3, 4, 5, 10, 14}; !reflect.DeepEqual(d.src, want) {
+		t.Errorf("got %v, want %v", d.src, want)
+	}
+	for _, test := range []struct{ pos, want int }{{0, 0}, {3, 0}, {4, 1}, {6, 3}, {14, 4}, {15, 5}, {100, 5}} {
+		if got := d.fromHtml(test.pos); got != test.want {
+			t.Errorf("fromHtml(%d): got %d, want %d", test.pos, got, test.want)
+		}
+	}
+
+	if s, ok := d.slice(2, 5); !ok || s != "& b" {
+		t.Errorf("slice(2, 5): got %q, %v", s, ok)
+	}
+	for _, r := range [][2]int{{-1, 2}, {3, 2}, {0, 6}} {
+		if _, ok := d.slice(r[0], r[1]); ok {
+			t.Errorf("slice(%d, %d): expected out of range", r[0], r[1])
+		}
+	}
+}
+
+func TestRuneOffset(t *testing.T) {
+	tests := []struct {
+
+		s string
+
+		pos int
+
+		want int
+
+	}{
+		{"abc", 0, 0},
+		{"abc", 2, 2},
+		{"abc", 9, 3},
+		{"a😀b<i>c</i>", 1, 1},
+		{"a😀b<i>c</i>", 3, 2},
+		{"a😀b<i>c</i>", 4, 3},
+		{"😀😀", 2, 1},
+		{"é😀", 3, 2},
+	}
+	for _, test := range tests {
+		if got := runeOffset(test.s, test.pos); got != test.want {
+			t.Errorf("runeOffset(%q, %d): got %d, want %d", test.s, test.pos, got, test.want)
+		}
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	text := "<p>The court held the contract void for mistake. 😀 On appeal the contract was found valid.</p>"
+	long := "The parties agreed that the defendant would deliver the goods by the end of the month, and that payment was due on delivery."
+	tests := []struct {
+
+		name string
+
+		html string
+
+		quote string
+
+		start, end int
+
+		want string
+
+		ok bool
+
+	}{
+		{"exact", text, "the contract", 15, 27, "the contract", true},
+		{"moved", text, "held the contract void", 0, 22, "held the contract void", true},
+		{"nearest", text, "the contract", 60, 70, "the contract", true},
+		{"edited", "<p>The court held the contract voided for a mistake.</p>", "held the contract void for mistake", 10, 44, "held the contract voided for a mistake", true},
+		{"non-BMP", "<p>😀😀 <b>hello</b> world</p>", "hello world", 0, 11, "hello world", true},
+		{"long edited", "<p>Facts. " + strings.Replace(long, "goods", "cargo", 1) + " Held.</p>", long, 0, len(long), strings.Replace(long, "goods", "cargo", 1), true},
+		{"gone", text, "the plaintiff was negligent in driving", 18, 30, "", false},
+		{"long gone", text, long, 0, len(long), "", false},
+		{"empty", text, "", 3, 5, "", false},
+	}
+	for _, test := range tests {
+		d := newDocText(test.html)
+		start, end, ok := d.anchor(test.quote, test.start, test.end)
+		if ok != test.ok {
+			t.Errorf("%s: got ok %v", test.name, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		got, _ := d.slice(start, end)
+		if got != test.want {
+			t.Errorf("%s: got %q at %d-%d, want %q", test.name, got, start, end, test.want)
+		}
+	}
+
+	// Of two exact matches the one nearer the old offsets.
+	d := newDocText(text)
+	if start, _, _ := d.anchor("the contract", 60, 72); start != 58 {
+		t.Errorf("nearest: got %d, want 58", start)
+	}
+	if start, _, _ := d.anchor("the contract", 0, 12); start != 15 {
+		t.Errorf("nearest: got %d, want 15", start)
+	}
+}
+
+func TestApproxFind(t *testing.T) {
+	tests := []struct {
+
+		text, pat string
+
+		maxDist int
+
+		want []approxMatch
+
+	}{
+		{"abcxdef", "abcdef", 1, []approxMatch{{0, 7, 1}}},
+		{"abcxdef", "abcdef", 0, []approxMatch{}},
+		{"abab", "ab", 0, []approxMatch{{0, 2, 0}, {2, 4, 0}}},
+		{"xxabdxx", "abcd", 1, []approxMatch{{2, 5, 1}}},
+		{"aaa", "xyz", 1, []approxMatch{}},
+		{"a😀c", "abc", 1, []approxMatch{{0, 3, 1}}},
+	}
+	for _, test := range tests {
+		got := approxFind([]rune(test.text), []rune(test.pat), test.maxDist)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("approxFind(%q, %q, %d): got %v, want %v", test.text, test.pat, test.maxDist, got, test.want)
+		}
+	}
+}
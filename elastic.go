@@ -1,10 +1,14 @@
 package main
 
 import (
-	"errors"
+	"bytes"
+	"encoding/json"
 	"fmt"
-
-	elastic "github.com/danlocke/elastic-go"
+	"log"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type Decision struct {
@@ -15,6 +19,16 @@ type Decision struct {
 
 	DateFiled string `json:"date_filed,omitempty"`
 
+	Court string `json:"court,omitempty"`
+
+	Citation string `json:"citation,omitempty"`
+
+	Judges string `json:"judges,omitempty"`
+
+	DocketNumber string `json:"docket_number,omitempty"`
+
+	Precedential string `json:"precedential_status,omitempty"`
+
 	Html string `json:"html,omitempty"`
 
 	Relevance string `json:"relevance,omitempty"`
@@ -34,6 +48,16 @@ type ApiCaseResponse struct {
 
 	DateFiled string `json:"date_filed,omitempty"`
 
+	Court string `json:"court,omitempty"`
+
+	Citation string `json:"citation,omitempty"`
+
+	Judges string `json:"judges,omitempty"`
+
+	DocketNumber string `json:"docket_number,omitempty"`
+
+	Precedential string `json:"precedential_status,omitempty"`
+
 	Html string `json:"html,omitempty"`
 
 	Relevance string `json:"relevance"`
@@ -51,86 +75,230 @@ type ApiSearchResponse struct {
 
 type ApiGetResponse Decision
 
-func parseDecisionFromMap(m map[string]interface{}) (Decision, error) {
-	dec := Decision{}
-	var ok bool
-	for k, v := range m {
-		switch k {
-			case "id":
-				f, ok := v.(float64)
-				dec.Id = fmt.Sprintf("%f", f)
-				if !ok {
-					return Decision{}, errors.New("Could not pass Id as int64")
-				}
-			case "name":
-				dec.CaseName, ok = v.(string)
-				if !ok {
-					return Decision{}, errors.New("Could not pass Case name as string")
-				}
-			case "date_filed":
-				dec.DateFiled, ok = v.(string)
-				if !ok {
-					return Decision{}, errors.New("Could not pass Date filed as string")
-				}
-			case "html":
-				dec.Html, ok = v.(string)
-				if !ok {
-					return Decision{}, errors.New("Could not pass html as string")
-				}
+// Names of the Decision fields in the index, set under elastic.fields in
+// config.json. Empty names take the defaults below.
+type esFieldMapping struct {
+
+	Id string `json:"id"`
+
+	Name string `json:"name"`
+
+	DateFiled string `json:"date_filed"`
+
+	Court string `json:"court"`
+
+	Citation string `json:"citation"`
+
+	Judges string `json:"judges"`
+
+	DocketNumber string `json:"docket_number"`
+
+	Precedential string `json:"precedential_status"`
+
+	Html string `json:"html"`
+
+}
+
+var defaultFieldMapping = esFieldMapping{
+	Id: "id",
+	Name: "name",
+	DateFiled: "date_filed",
+	Court: "court",
+	Citation: "citation",
+	Judges: "judges",
+	DocketNumber: "docket_number",
+	Precedential: "precedential_status",
+	Html: "html",
+}
+
+func (m esFieldMapping) withDefaults() esFieldMapping {
+	d := defaultFieldMapping
+	for _, f := range []struct{ v *string; def string }{
+		{&m.Id, d.Id}, {&m.Name, d.Name}, {&m.DateFiled, d.DateFiled},
+		{&m.Court, d.Court}, {&m.Citation, d.Citation}, {&m.Judges, d.Judges},
+		{&m.DocketNumber, d.DocketNumber}, {&m.Precedential, d.Precedential},
+		{&m.Html, d.Html},
+	} {
+		if *f.v == "" {
+			*f.v = f.def
 		}
 	}
-	return dec, nil
+	return m
+}
+
+// Fields in sources that are not mapped, logged once each.
+var unmappedFields sync.Map
+
+// Source field types, each decoding into its Decision field's text.
+type esId string
+
+type esString string
+
+type esStrings string
+
+func (v *esId) UnmarshalJSON(raw []byte) error {
+	s, err := decodeId(raw)
+	*v = esId(s)
+	return err
+}
+
+func (v *esString) UnmarshalJSON(raw []byte) error {
+	s, err := decodeString(raw)
+	*v = esString(s)
+	return err
+}
+
+func (v *esStrings) UnmarshalJSON(raw []byte) error {
+	s, err := decodeStrings(raw)
+	*v = esStrings(s)
+	return err
+}
+
+// A source struct type for a mapping, with a field tagged with each mapped
+// name, and the index of the field each Decision field is read from.
+type esSourceType struct {
+
+	t reflect.Type
+
+	index []int
+
+}
+
+// Built once per mapping.
+var sourceTypes sync.Map
+
+func (m esFieldMapping) sourceType() esSourceType {
+	if st, ok := sourceTypes.Load(m); ok {
+		return st.(esSourceType)
+	}
+	// In the order of Decision fields read in decode.
+	mapped := []struct{ name string; t reflect.Type }{
+		{m.Id, reflect.TypeOf(esId(""))},
+		{m.Name, reflect.TypeOf(esString(""))},
+		{m.DateFiled, reflect.TypeOf(esString(""))},
+		{m.Court, reflect.TypeOf(esString(""))},
+		{m.Citation, reflect.TypeOf(esStrings(""))},
+		{m.Judges, reflect.TypeOf(esStrings(""))},
+		{m.DocketNumber, reflect.TypeOf(esString(""))},
+		{m.Precedential, reflect.TypeOf(esString(""))},
+		{m.Html, reflect.TypeOf(esString(""))},
+	}
+	// A name mapped twice is one struct field, encoding/json drops fields
+	// with clashing tags.
+	st := esSourceType{}
+	fields := []reflect.StructField{}
+	seen := map[string]int{}
+	for _, f := range mapped {
+		j, ok := seen[f.name]
+		if !ok {
+			j = len(fields)
+			seen[f.name] = j
+			fields = append(fields, reflect.StructField{
+				Name: fmt.Sprintf("F%d", j),
+				Type: f.t,
+				Tag: reflect.StructTag(fmt.Sprintf(`json:%q`, f.name)),
+			})
+		}
+		st.index = append(st.index, j)
+	}
+	st.t = reflect.StructOf(fields)
+	sourceTypes.Store(m, st)
+	return st
 }
 
-func elasticGetToApiResponse(s *elastic.GetResponse) (*ApiGetResponse, error) {
-	res, err := parseDecisionFromMap(s.Source.(map[string]interface{}))
+// Decodes a hit or document source into a Decision, through a struct built
+// from the mapping so each field is decoded by its type rather than from
+// whatever the client unmarshalled it to.
+func (m esFieldMapping) decode(source interface{}) (Decision, error) {
+	raw, ok := source.(json.RawMessage)
+	if !ok {
+		var err error
+		raw, err = json.Marshal(source)
+		if err != nil {
+			return Decision{}, err
+		}
+	}
+	st := m.sourceType()
+	v := reflect.New(st.t)
+	err := json.Unmarshal(raw, v.Interface())
 	if err != nil {
-		return nil, err
+		return Decision{}, fmt.Errorf("Could not decode source: %v", err)
+	}
+	field := func(j int) string {
+		return v.Elem().Field(st.index[j]).String()
+	}
+	dec := Decision{
+		Id: field(0),
+		CaseName: field(1),
+		DateFiled: field(2),
+		Court: field(3),
+		Citation: field(4),
+		Judges: field(5),
+		DocketNumber: field(6),
+		Precedential: field(7),
+		Html: field(8),
 	}
-	r := ApiGetResponse(res)
 
-	return &r, nil
+	var keys map[string]json.RawMessage
+	err = json.Unmarshal(raw, &keys)
+	if err != nil {
+		return Decision{}, err
+	}
+	for k := range keys {
+		if sourceHasField(st.t, k) {
+			continue
+		}
+		if _, seen := unmappedFields.LoadOrStore(k, true); !seen {
+			log.Printf("elastic - ignoring unmapped source field %s.\n", k)
+		}
+	}
+	return dec, nil
 }
 
-// func (i *Instance) elasticSearchToApiCaseResponse(userId int64, topicId string, s *elastic.SearchResponse) (*SearchResponse, error) {
-// 	res := make([]ApiCaseResponse, 0)
-
-// 	assessed, err := dbGetAssessedPerTopic(i.db, userId, topicId)
-// 	if err != nil {
-// 		return nil, err
-// 	}
+func sourceHasField(t reflect.Type, name string) bool {
+	for j := 0; j < t.NumField(); j++ {
+		if t.Field(j).Tag.Get("json") == name {
+			return true
+		}
+	}
+	return false
+}
 
-// 	for j := range s.Hits.Hits {
-// 		hit, err := parseDecisionFromMap(s.Hits.Hits[j].Source.(map[string]interface{}))
-// 		if err != nil {
-// 			return nil, err
-// 		}
-// 		stored := false
-// 		relevance := ""
-// 		if k, ok := assessed[s.Hits.Hits[j].Id]; ok {
-// 			relevance = k
-// 			stored = true
-// 		}
-// 		res = append(res, ApiCaseResponse {
-// 			Score : s.Hits.Hits[j].Score,
-// 			Id : s.Hits.Hits[j].Id,
-// 			CaseName : hit.CaseName,
-// 			DateFiled : hit.DateFiled,
-// 			Html : hit.Html,
-// 			Stored: stored,
-// 			Relevance: relevance,
-// 		})
-// 	}
+// Ids are numbers in the CourtListener index but strings in elasticsearch
+// hits, either is accepted and kept as its integer text.
+func decodeId(raw json.RawMessage) (string, error) {
+	var n json.Number
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&n)
+	if err == nil {
+		if i, err := n.Int64(); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+		return n.String(), nil
+	}
+	return decodeString(raw)
+}
 
-// 	r := SearchResponse {
-// 		TotalHits: int(s.Hits.Total),
-// 		Results: res,
-// 	}
+func decodeString(raw json.RawMessage) (string, error) {
+	if string(raw) == "null" {
+		return "", nil
+	}
+	var s string
+	err := json.Unmarshal(raw, &s)
+	return s, err
+}
 
-// 	return &r, nil
-// }
+// A string or a list of strings, joined with "; ".
+func decodeStrings(raw json.RawMessage) (string, error) {
+	var l []string
+	if json.Unmarshal(raw, &l) == nil {
+		return strings.Join(l, "; "), nil
+	}
+	return decodeString(raw)
+}
 
-func (i *Instance) elasticSearchToApiSearchResponse(userId int64, topicId string, s *elastic.SearchResponse) (*ApiSearchResponse, error) {
+func (i *Instance) searchToApiSearchResponse(userId int64, topicId string, s *SearchResult) (*ApiSearchResponse, error) {
 	res := make([]ApiCaseResponse, 0)
 
 	assessed, err := dbGetAssessedPerTopic(i.db, userId, topicId)
@@ -138,22 +306,24 @@ func (i *Instance) elasticSearchToApiSearchResponse(userId int64, topicId string
 		return nil, err
 	}
 
-	for j := range s.Hits.Hits {
-		hit, err := parseDecisionFromMap(s.Hits.Hits[j].Source.(map[string]interface{}))
-		if err != nil {
-			return nil, err
-		}
+	for j := range s.Hits {
+		hit := s.Hits[j].Decision
 		stored := false
 		relevance := ""
-		if k, ok := assessed[s.Hits.Hits[j].Id]; ok {
+		if k, ok := assessed[s.Hits[j].Id]; ok {
 			relevance = k
 			stored = true
 		}
 		res = append(res, ApiCaseResponse {
-			Score : s.Hits.Hits[j].Score,
-			Id : s.Hits.Hits[j].Id,
+			Score : s.Hits[j].Score,
+			Id : s.Hits[j].Id,
 			CaseName : hit.CaseName,
 			DateFiled : hit.DateFiled,
+			Court: hit.Court,
+			Citation: hit.Citation,
+			Judges: hit.Judges,
+			DocketNumber: hit.DocketNumber,
+			Precedential: hit.Precedential,
 			Html : hit.Html,
 			Stored: stored,
 			Relevance: relevance,
@@ -161,7 +331,7 @@ func (i *Instance) elasticSearchToApiSearchResponse(userId int64, topicId string
 	}
 
 	r := ApiSearchResponse {
-		TotalHits: int(s.Hits.Total),
+		TotalHits: int(s.Total),
 		Results: res,
 	}
 
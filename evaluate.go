@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Runs are evaluated against qrels built from the assessment table, the
+// majority grade of each judged document. Documents graded above the lowest
+// grade are relevant, and nDCG gains are grades less the lowest grade. Every
+// topic with a relevant document is evaluated, a run without results for one
+// scores 0 on it (trec_eval -c).
+const defaultEvalDepth = 10
+
+// A TREC run, topic Q0 doc rank score tag.
+type trecRun struct {
+
+	Name string
+
+	// Documents per topic, best first.
+	Topics map[string][]runDoc
+
+}
+
+type runDoc struct {
+
+	Id string
+
+	Score float64
+
+}
+
+// Reads a run, ordering each topic's documents by score as trec_eval does
+// (ties by descending doc id) and dropping repeated documents. The run is
+// named by its tag, or name if it has none.
+func readRun(r io.Reader, name string) (*trecRun, error) {
+	run := &trecRun{Topics: map[string][]runDoc{}}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64 * 1024), 1024 * 1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%s line %d: expected topic Q0 doc rank score tag", name, line)
+		}
+		score, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", name, line, err)
+		}
+		if run.Name == "" && len(fields) > 5 {
+			run.Name = fields[5]
+		}
+		run.Topics[fields[0]] = append(run.Topics[fields[0]], runDoc{fields[2], score})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if run.Name == "" {
+		run.Name = name
+	}
+
+	for t, docs := range run.Topics {
+		sort.SliceStable(docs, func(a, b int) bool {
+			if docs[a].Score != docs[b].Score {
+				return docs[a].Score > docs[b].Score
+			}
+			return docs[a].Id > docs[b].Id
+		})
+		seen := map[string]bool{}
+		unique := docs[:0]
+		for _, d := range docs {
+			if !seen[d.Id] {
+				seen[d.Id] = true
+				unique = append(unique, d)
+			}
+		}
+		run.Topics[t] = unique
+	}
+	return run, nil
+}
+
+func readRunFile(path string) (*trecRun, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readRun(f, filepath.Base(path))
+}
+
+type TopicEvaluation struct {
+
+	TopicId string `json:"topic"`
+
+	Metrics map[string]stat `json:"metrics"`
+
+}
+
+type RunEvaluation struct {
+
+	Run string `json:"run"`
+
+	// Means over the evaluated topics.
+	Mean map[string]stat `json:"mean"`
+
+	Topics []TopicEvaluation `json:"topics"`
+
+}
+
+// A paired t-test of B against A over the evaluated topics.
+type RunComparison struct {
+
+	A string `json:"a"`
+
+	B string `json:"b"`
+
+	Metric string `json:"metric"`
+
+	// Mean of B - A.
+	Diff stat `json:"diff"`
+
+	T stat `json:"t"`
+
+	// Two sided.
+	P stat `json:"p"`
+
+}
+
+type EvaluationReport struct {
+
+	Depth int `json:"depth"`
+
+	Metrics []string `json:"metrics"`
+
+	// Topics with a relevant document.
+	Topics []string `json:"topics"`
+
+	Runs []RunEvaluation `json:"runs"`
+
+	Comparisons []RunComparison `json:"comparisons"`
+
+}
+
+type evalOptions struct {
+
+	// Cutoff for nDCG, P, recall and judged.
+	Depth int
+
+	// If empty then all topics.
+	Topics map[string]bool
+
+	Adjudicated bool
+
+}
+
+func evalMetrics(k int) []string {
+	return []string{"map", fmt.Sprintf("ndcg@%d", k), fmt.Sprintf("p@%d", k),
+		fmt.Sprintf("recall@%d", k), "bpref", fmt.Sprintf("judged@%d", k)}
+}
+
+// Gains of each judged document per topic.
+func (i *Instance) evalQrels(opts evalOptions) (map[string]map[string]int, error) {
+	q, err := i.qrels(qrelOptions{Topics: opts.Topics, Consolidate: consolidateMajority, Adjudicated: opts.Adjudicated})
+	if err != nil {
+		return nil, err
+	}
+	labels, _ := i.gradeLabels()
+	lowest := i.grades()[labels[0]]
+	judged := map[string]map[string]int{}
+	for _, r := range q {
+		t := strconv.FormatInt(r.TopicId, 10)
+		if _, ok := judged[t]; !ok {
+			judged[t] = map[string]int{}
+		}
+		judged[t][strconv.FormatInt(r.DocId, 10)] = r.Relevance - lowest
+	}
+	return judged, nil
+}
+
+func (i *Instance) evaluate(runs []*trecRun, opts evalOptions) (*EvaluationReport, error) {
+	if opts.Depth <= 0 {
+		opts.Depth = defaultEvalDepth
+	}
+	judged, err := i.evalQrels(opts)
+	if err != nil {
+		return nil, err
+	}
+	topics := []string{}
+	for t, docs := range judged {
+		for _, g := range docs {
+			if g > 0 {
+				topics = append(topics, t)
+				break
+			}
+		}
+	}
+	sort.Slice(topics, func(a, b int) bool {
+		x, _ := strconv.Atoi(topics[a])
+		y, _ := strconv.Atoi(topics[b])
+		return x < y
+	})
+
+	metrics := evalMetrics(opts.Depth)
+	report := &EvaluationReport{Depth: opts.Depth, Metrics: metrics, Topics: topics,
+		Runs: []RunEvaluation{}, Comparisons: []RunComparison{}}
+	for _, run := range runs {
+		e := RunEvaluation{Run: run.Name, Mean: map[string]stat{}, Topics: []TopicEvaluation{}}
+		sums := map[string]float64{}
+		for _, t := range topics {
+			values := evalTopic(run.Topics[t], judged[t], opts.Depth)
+			m := map[string]stat{}
+			for j, name := range metrics {
+				m[name] = stat(values[j])
+				sums[name] += values[j]
+			}
+			e.Topics = append(e.Topics, TopicEvaluation{t, m})
+		}
+		for _, name := range metrics {
+			e.Mean[name] = stat(sums[name] / float64(len(topics)))
+		}
+		report.Runs = append(report.Runs, e)
+	}
+
+	for a := range report.Runs {
+		for b := a + 1; b < len(report.Runs); b++ {
+			for _, name := range metrics {
+				diffs := make([]float64, len(topics))
+				for j := range topics {
+					diffs[j] = float64(report.Runs[b].Topics[j].Metrics[name] - report.Runs[a].Topics[j].Metrics[name])
+				}
+				mean, t, p := pairedTTest(diffs)
+				report.Comparisons = append(report.Comparisons, RunComparison{
+					A: report.Runs[a].Run,
+					B: report.Runs[b].Run,
+					Metric: name,
+					Diff: stat(mean),
+					T: stat(t),
+					P: stat(p),
+				})
+			}
+		}
+	}
+	return report, nil
+}
+
+// Metric values in the order of evalMetrics for one topic.
+func evalTopic(docs []runDoc, gains map[string]int, k int) []float64 {
+	rel, nonrel := 0, 0
+	ideal := []int{}
+	for _, g := range gains {
+		if g > 0 {
+			rel++
+			ideal = append(ideal, g)
+		} else {
+			nonrel++
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ideal)))
+
+	var ap, dcg, idcg, bpref float64
+	relK, judgedK, relRet, nonrelRet := 0, 0, 0, 0
+	for r, d := range docs {
+		g, isJudged := gains[d.Id]
+		if r < k {
+			if isJudged {
+				judgedK++
+			}
+			if g > 0 {
+				relK++
+			}
+			dcg += float64(g) / math.Log2(float64(r + 2))
+		}
+		if !isJudged {
+			continue
+		}
+		if g > 0 {
+			relRet++
+			ap += float64(relRet) / float64(r + 1)
+			if n := math.Min(float64(rel), float64(nonrel)); n > 0 {
+				bpref += 1 - math.Min(float64(nonrelRet), float64(rel)) / n
+			} else {
+				bpref++
+			}
+		} else {
+			nonrelRet++
+		}
+	}
+	for r := 0; r < k && r < len(ideal); r++ {
+		idcg += float64(ideal[r]) / math.Log2(float64(r + 2))
+	}
+
+	ndcg := 0.0
+	if idcg > 0 {
+		ndcg = dcg / idcg
+	}
+	return []float64{
+		ap / float64(rel),
+		ndcg,
+		float64(relK) / float64(k),
+		float64(relK) / float64(rel),
+		bpref / float64(rel),
+		float64(judgedK) / float64(k),
+	}
+}
+
+// Mean difference, t statistic and two sided p value.
+func pairedTTest(diffs []float64) (float64, float64, float64) {
+	n := float64(len(diffs))
+	if n < 2 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	mean := 0.0
+	for _, d := range diffs {
+		mean += d
+	}
+	mean /= n
+	variance := 0.0
+	for _, d := range diffs {
+		variance += (d - mean) * (d - mean)
+	}
+	variance /= n - 1
+	if variance == 0 {
+		if mean == 0 {
+			return mean, 0, 1
+		}
+		return mean, math.Inf(int(math.Copysign(1, mean))), 0
+	}
+	t := mean / math.Sqrt(variance / n)
+	df := n - 1
+	return mean, t, betaInc(df / 2, 0.5, df / (df + t * t))
+}
+
+func writeEvaluation(w io.Writer, report *EvaluationReport, perTopic bool) error {
+	bw := bufio.NewWriter(w)
+	for _, run := range report.Runs {
+		if perTopic {
+			for _, t := range run.Topics {
+				for _, name := range report.Metrics {
+					fmt.Fprintf(bw, "%s\t%s\t%s\t%.4f\n", run.Run, name, t.TopicId, float64(t.Metrics[name]))
+				}
+			}
+		}
+		for _, name := range report.Metrics {
+			fmt.Fprintf(bw, "%s\t%s\tall\t%.4f\n", run.Run, name, float64(run.Mean[name]))
+		}
+	}
+	for _, c := range report.Comparisons {
+		fmt.Fprintf(bw, "%s\t%s\t%s\tdiff %.4f\tt %.3f\tp %.4f\n", c.B, c.A, c.Metric,
+			float64(c.Diff), float64(c.T), float64(c.P))
+	}
+	return bw.Flush()
+}
+
+// Evaluation handlers -----------------------------------------------------------
+
+// POST /admin/evaluate?depth=10&topics=1,2&adjudicated=true with run files
+// uploaded as multipart field runs.
+func apiEvaluateRuns(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	err := r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		return 400, err
+	}
+	files := r.MultipartForm.File["runs"]
+	if len(files) == 0 {
+		return 400, errors.New("No run files uploaded")
+	}
+	opts := evalOptions{
+		Topics: parseFilter(r.FormValue("topics")),
+		Adjudicated: r.FormValue("adjudicated") == "true",
+	}
+	if d := r.FormValue("depth"); d != "" {
+		opts.Depth, err = strconv.Atoi(d)
+		if err != nil {
+			return 400, err
+		}
+	}
+
+	runs := make([]*trecRun, 0, len(files))
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			return 400, err
+		}
+		run, err := readRun(f, fh.Filename)
+		f.Close()
+		if err != nil {
+			return 400, err
+		}
+		runs = append(runs, run)
+	}
+
+	report, err := i.evaluate(runs, opts)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(report)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func evaluateCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("evaluate", flag.ExitOnError)
+	depth := fs.Int("depth", defaultEvalDepth, "Cutoff for nDCG, P, recall and judged")
+	topics := fs.String("topics", "", "Comma separated topic ids [if empty then all]")
+	adjudicated := fs.Bool("adjudicated", false, "Use adjudicated labels where present")
+	perTopic := fs.Bool("q", false, "Also write each topic's values")
+	asJson := fs.Bool("json", false, "Write the report as json")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("Usage: evaluate [-depth k] [-topics 1,2] [-adjudicated] [-q] [-json] run...")
+	}
+
+	runs := make([]*trecRun, 0, fs.NArg())
+	for _, path := range fs.Args() {
+		run, err := readRunFile(path)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run)
+	}
+	report, err := i.evaluate(runs, evalOptions{Depth: *depth, Topics: parseFilter(*topics), Adjudicated: *adjudicated})
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	return writeEvaluation(os.Stdout, report, *perTopic)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func runDocs(ids ...string) []runDoc {
+	docs := make([]runDoc, len(ids))
+	for j, id := range ids {
+		docs[j] = runDoc{id, float64(len(ids) - j)}
+	}
+	return docs
+}
+
+func TestEvalTopic(t *testing.T) {
+	// Four relevant (d3 graded 2) and two non-relevant, d7 unjudged.
+	gains := map[string]int{"d1": 1, "d2": 0, "d3": 2, "d4": 1, "d5": 0, "d6": 1}
+	idcg := 2 + 1 / math.Log2(3) + 1 / math.Log2(4) + 1 / math.Log2(5)
+	tests := []struct {
+
+		name string
+
+		docs []runDoc
+
+		// map, ndcg@5, p@5, recall@5, bpref, judged@5 as trec_eval gives
+		// them, judged being the share of the top 5 judged.
+		want []float64
+
+	}{
+		// AP (1/1 + 2/4 + 3/6) / 4, nDCG 0.5226 and bpref (1 + (1 - 1/2) +
+		// (1 - 2/2)) / 4, against min(R, N) = 2 non-relevant.
+		{"mixed", runDocs("d1", "d2", "d7", "d3", "d5", "d4"),
+			[]float64{0.5, (1 + 2 / math.Log2(5)) / idcg, 0.4, 0.5, 0.375, 0.8}},
+		{"ideal", runDocs("d3", "d1", "d4", "d6", "d2", "d5"),
+			[]float64{1, 1, 0.8, 1, 1, 1}},
+		// Non-relevant above every relevant one, bpref 0.
+		{"worst", runDocs("d2", "d5", "d1", "d3"),
+			[]float64{(1.0 / 3 + 2.0 / 4) / 4, (1 / math.Log2(4) + 2 / math.Log2(5)) / idcg, 0.4, 0.5, 0, 0.8}},
+		// No results for the topic score 0 (trec_eval -c).
+		{"empty", nil, []float64{0, 0, 0, 0, 0, 0}},
+	}
+	for _, test := range tests {
+		got := evalTopic(test.docs, gains, 5)
+		for j, name := range evalMetrics(5) {
+			if math.Abs(got[j] - test.want[j]) > 1e-9 {
+				t.Errorf("%s: %s %v, want %v", test.name, name, got[j], test.want[j])
+			}
+		}
+	}
+
+	// With no judged non-relevant documents each relevant one retrieved
+	// counts fully towards bpref.
+	got := evalTopic(runDocs("a", "x", "b"), map[string]int{"a": 1, "b": 1, "c": 1}, 5)
+	if math.Abs(got[4] - 2.0 / 3) > 1e-9 {
+		t.Errorf("bpref %v, want %v", got[4], 2.0 / 3)
+	}
+}
+
+func TestPairedTTest(t *testing.T) {
+	tests := []struct {
+
+		diffs []float64
+
+		mean, t, p float64
+
+	}{
+		// df 3, p from the Student t CDF in closed form.
+		{[]float64{1, 2, 3, 4}, 2.5, 3.872983346207417, 0.030466291662170963},
+		// df 2, p = 1 - t / sqrt(2 + t^2).
+		{[]float64{0.1, 0.3, 0.2}, 0.2, 3.4641016151377544, 0.07417990022744858},
+		{[]float64{-0.1, -0.3, -0.2}, -0.2, -3.4641016151377544, 0.07417990022744858},
+		{[]float64{0, 0, 0}, 0, 0, 1},
+		{[]float64{0.5, 0.5}, 0.5, math.Inf(1), 0},
+	}
+	for _, test := range tests {
+		mean, tt, p := pairedTTest(test.diffs)
+		if math.Abs(mean - test.mean) > 1e-9 || !(tt == test.t || math.Abs(tt - test.t) < 1e-9) || math.Abs(p - test.p) > 1e-9 {
+			t.Errorf("%v: got %v %v %v, want %v %v %v", test.diffs, mean, tt, p, test.mean, test.t, test.p)
+		}
+	}
+
+	mean, _, _ := pairedTTest([]float64{1})
+	if !math.IsNaN(mean) {
+		t.Errorf("got %v for one topic, want NaN", mean)
+	}
+}
+
+func TestReadRun(t *testing.T) {
+	run, err := readRun(strings.NewReader(`1 Q0 a 1 0.5 sys
+1 Q0 b 2 0.9 sys
+1 Q0 c 3 0.5 sys
+1 Q0 b 4 0.1 sys
+
+2 Q0 x 1 1 sys
+`), "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Name != "sys" {
+		t.Errorf("name %q, want sys", run.Name)
+	}
+	// By score, ties by descending id, the repeat of b dropped.
+	want := []runDoc{{"b", 0.9}, {"c", 0.5}, {"a", 0.5}}
+	if !reflect.DeepEqual(run.Topics["1"], want) {
+		t.Errorf("got %v, want %v", run.Topics["1"], want)
+	}
+	if len(run.Topics["2"]) != 1 {
+		t.Errorf("got %v for topic 2", run.Topics["2"])
+	}
+
+	run, err = readRun(strings.NewReader("1 Q0 a 1 0.5\n"), "file")
+	if err != nil || run.Name != "file" {
+		t.Errorf("got %v, %v, want a run named file", run, err)
+	}
+	for _, bad := range []string{"1 Q0 a 1\n", "1 Q0 a 1 high sys\n"} {
+		if _, err := readRun(strings.NewReader(bad), "file"); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// One line per (topic, doc), the most common grade wins.
+	consolidateMajority string = "majority"
+
+	// One line per assessor judgment, the iteration column holds the assessor id.
+	consolidateNone string = "none"
+)
+
+var defaultGrades = map[string]int{
+	"not relevant": 0,
+	"background": 1,
+	"explanatory": 2,
+	"on point": 3,
+}
+
+type qrel struct {
+
+	TopicId int64
+
+	Iteration string
+
+	DocId int64
+
+	Relevance int
+
+}
+
+type qrelOptions struct {
+
+	// If empty then all topics.
+	Topics map[string]bool
+
+	// If non-zero then only this assessor's judgments.
+	Assessor int64
+
+	Consolidate string
+
+	// Use adjudicated labels in place of the majority where present.
+	Adjudicated bool
+
+}
+
+// Relevance grade for each assessType label, from config or the default
+// ordering of the enum.
+func (i *Instance) grades() map[string]int {
+	if len(i.config.Qrels.Grades) > 0 {
+		return i.config.Qrels.Grades
+	}
+	return defaultGrades
+}
+
+func (i *Instance) qrels(opts qrelOptions) ([]qrel, error) {
+	assessments, err := dbGetAssessments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	grades := i.grades()
+
+	type key struct{ topic, doc int64 }
+	votes := map[key][]int{}
+	res := []qrel{}
+	for _, a := range assessments {
+		if len(opts.Topics) > 0 && !opts.Topics[strconv.FormatInt(a.TopicId, 10)] {
+			continue
+		}
+		if opts.Assessor != 0 && a.UserId != opts.Assessor {
+			continue
+		}
+		g, ok := grades[a.Relevance]
+		if !ok {
+			return nil, fmt.Errorf("No grade configured for %q", a.Relevance)
+		}
+		switch opts.Consolidate {
+			case consolidateNone:
+				res = append(res, qrel{a.TopicId, strconv.FormatInt(a.UserId, 10), a.DocId, g})
+			case consolidateMajority, "":
+				k := key{a.TopicId, a.DocId}
+				votes[k] = append(votes[k], g)
+			default:
+				return nil, fmt.Errorf("Unknown consolidation %q", opts.Consolidate)
+		}
+	}
+
+	var adjudicated map[[2]int64]string
+	if opts.Adjudicated && opts.Assessor == 0 && len(votes) > 0 {
+		adjudicated, err = dbGetAdjudications(i.db)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range votes {
+		g := majorityGrade(v)
+		if l, ok := adjudicated[[2]int64{k.topic, k.doc}]; ok {
+			g = grades[l]
+		}
+		res = append(res, qrel{k.topic, "0", k.doc, g})
+	}
+
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].TopicId != res[b].TopicId {
+			return res[a].TopicId < res[b].TopicId
+		}
+		if res[a].DocId != res[b].DocId {
+			return res[a].DocId < res[b].DocId
+		}
+		return res[a].Iteration < res[b].Iteration
+	})
+	return res, nil
+}
+
+// Most common grade, ties go to the higher grade.
+func majorityGrade(grades []int) int {
+	counts := map[int]int{}
+	for _, g := range grades {
+		counts[g]++
+	}
+	best, n := 0, -1
+	for g, c := range counts {
+		if c > n || (c == n && g > best) {
+			best, n = g, c
+		}
+	}
+	return best
+}
+
+func writeQrels(w io.Writer, q []qrel) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range q {
+		_, err := fmt.Fprintf(bw, "%d %s %d %d\n", r.TopicId, r.Iteration, r.DocId, r.Relevance)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Comma separated values, ie. topic ids or tag categories.
+func parseFilter(s string) map[string]bool {
+	values := map[string]bool{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values[v] = true
+		}
+	}
+	return values
+}
+
+func dbGetAssessments(db *sql.DB) ([]Assessment, error) {
+	rows, err := db.Query("SELECT topic_id, doc_id, assessor, relevant, date_assessed FROM assessment WHERE relevant IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	assessments := make([]Assessment, 0)
+	for rows.Next() {
+		var a Assessment
+		err = rows.Scan(&a.TopicId, &a.DocId, &a.UserId, &a.Relevance, &a.Date)
+		if err != nil {
+			return nil, err
+		}
+		assessments = append(assessments, a)
+	}
+	return assessments, rows.Err()
+}
+
+func dbGetUserIdByName(db *sql.DB, name string) (int64, error) {
+	var user_id int64
+	err := db.QueryRow("SELECT user_id FROM users WHERE name = $1", name).Scan(&user_id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("No such user %s", name)
+	}
+	return user_id, err
+}
+
+// Export handlers ---------------------------------------------------------------
+
+// GET /export/qrels?topics=1,2&assessor=name&consolidate=majority|none&adjudicated=true
+func exportQrelsHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	opts := qrelOptions{
+		Topics: parseFilter(r.FormValue("topics")),
+		Consolidate: r.FormValue("consolidate"),
+		Adjudicated: r.FormValue("adjudicated") == "true",
+	}
+	if name := r.FormValue("assessor"); name != "" {
+		id, err := dbGetUserIdByName(i.db, strings.ToLower(name))
+		if err != nil {
+			return 400, err
+		}
+		opts.Assessor = id
+	}
+
+	q, err := i.qrels(opts)
+	if err != nil {
+		return 400, err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=qrels.txt")
+	err = writeQrels(w, q)
+	if err != nil {
+		return 500, err
+	}
+	return 200, nil
+}
+
+func exportQrelsCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("export-qrels", flag.ExitOnError)
+	topics := fs.String("topics", "", "Comma separated topic ids [if empty then all]")
+	consolidate := fs.String("consolidate", consolidateMajority, "majority or none")
+	adjudicated := fs.Bool("adjudicated", false, "Use adjudicated labels where present (majority only)")
+	assessor := fs.String("assessor", "", "Only export this assessor's judgments")
+	perAssessor := fs.Bool("per-assessor", false, "Write one qrels file per assessor into -o")
+	out := fs.String("o", "", "Output file, or directory with -per-assessor [if empty then stdout]")
+	fs.Parse(args)
+
+	opts := qrelOptions{
+		Topics: parseFilter(*topics),
+		Consolidate: *consolidate,
+		Adjudicated: *adjudicated,
+	}
+
+	if *perAssessor {
+		if *out == "" {
+			return errors.New("-per-assessor requires an output directory -o")
+		}
+		err := os.MkdirAll(*out, 0775)
+		if err != nil {
+			return err
+		}
+		users, err := dbGetUsers(i.db)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			opts.Assessor = u.Id
+			q, err := i.qrels(opts)
+			if err != nil {
+				return err
+			}
+			if len(q) == 0 {
+				continue
+			}
+			err = writeQrelsFile(filepath.Join(*out, "qrels." + u.Name + ".txt"), q)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if *assessor != "" {
+		id, err := dbGetUserIdByName(i.db, strings.ToLower(*assessor))
+		if err != nil {
+			return err
+		}
+		opts.Assessor = id
+	}
+	q, err := i.qrels(opts)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return writeQrels(os.Stdout, q)
+	}
+	return writeQrelsFile(*out, q)
+}
+
+func writeQrelsFile(path string, q []qrel) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = writeQrels(f, q)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Each topic's extracts quote the cases the topic decision cites (CitedId),
+// so where an assessor judged a cited decision their tags would be expected
+// to cover the quoted passage. Extracts are located in the cited decision's
+// plain text as tags are, allowing for small differences, and coverage is
+// measured in tokens as for tag agreement.
+type ExtractCoverage struct {
+
+	Assessor string `json:"assessor"`
+
+	// Cited decisions the assessor judged that have an extract located.
+	Docs int `json:"docs"`
+
+	// Extracts located, and those overlapped by at least one tag.
+	Extracts int `json:"extracts"`
+
+	ExtractsTagged int `json:"extracts_tagged"`
+
+	// Extract tokens, those covered by tags, and all tokens tagged in these
+	// decisions.
+	Tokens int `json:"tokens"`
+
+	TokensCovered int `json:"tokens_covered"`
+
+	TokensTagged int `json:"tokens_tagged"`
+
+	// TokensCovered / Tokens
+	Coverage stat `json:"coverage"`
+
+	// TokensCovered / TokensTagged, the share of tagging spent on extracts.
+	Precision stat `json:"precision"`
+
+}
+
+type TopicExtractCoverage struct {
+
+	TopicId string `json:"topic"`
+
+	// Cited decisions judged by anyone with an extract located.
+	CitedDocs int `json:"cited_docs"`
+
+	// Extracts of judged cited decisions that could not be located.
+	Unlocated int `json:"unlocated"`
+
+	Coverage stat `json:"coverage"`
+
+	Assessors []ExtractCoverage `json:"assessors"`
+
+}
+
+type ExtractReport struct {
+
+	Topics []TopicExtractCoverage `json:"topics"`
+
+	// Each assessor over all topics.
+	Assessors []ExtractCoverage `json:"assessors"`
+
+}
+
+// Token counts summed over documents.
+type extractCounts struct{ docs, extracts, tagged, tokens, covered, tagTokens int }
+
+func (c *extractCounts) add(o extractCounts) {
+	c.docs += o.docs
+	c.extracts += o.extracts
+	c.tagged += o.tagged
+	c.tokens += o.tokens
+	c.covered += o.covered
+	c.tagTokens += o.tagTokens
+}
+
+func (c extractCounts) coverage(assessor string) ExtractCoverage {
+	return ExtractCoverage{
+		Assessor: assessor,
+		Docs: c.docs,
+		Extracts: c.extracts,
+		ExtractsTagged: c.tagged,
+		Tokens: c.tokens,
+		TokensCovered: c.covered,
+		TokensTagged: c.tagTokens,
+		Coverage: ratio(c.covered, c.tokens),
+		Precision: ratio(c.covered, c.tagTokens),
+	}
+}
+
+// Extract text quoted from each cited decision. CitedId and CaseExtract are
+// parallel, each extract being from the decision at the same index, only when
+// their lengths differ is every extract looked for in every cited decision.
+func (t Topic) citedExtracts() map[int64][]string {
+	cited := map[int64][]string{}
+	add := func(id int, x string) {
+		if x = strings.TrimSpace(x); x != "" {
+			cited[int64(id)] = append(cited[int64(id)], x)
+		}
+	}
+	for _, e := range t.Extracts {
+		if len(e.CitedId) == len(e.CaseExtract) {
+			for k, id := range e.CitedId {
+				add(id, e.CaseExtract[k])
+			}
+			continue
+		}
+		for _, id := range e.CitedId {
+			for _, x := range e.CaseExtract {
+				add(id, x)
+			}
+		}
+	}
+	return cited
+}
+
+func (i *Instance) extractReport() (*ExtractReport, error) {
+	assessments, err := dbGetAssessments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := dbGetLiveTags(i.db)
+	if err != nil {
+		return nil, err
+	}
+	users, err := dbGetUsers(i.db)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int64]string{}
+	for _, u := range users {
+		names[u.Id] = u.Name
+	}
+
+	type docKey struct{ topic, doc int64 }
+	judged := map[docKey][]int64{}
+	for _, a := range assessments {
+		k := docKey{a.TopicId, a.DocId}
+		judged[k] = append(judged[k], a.UserId)
+	}
+	byDoc := map[docKey]map[int64][]Tag{}
+	for _, t := range tags {
+		k := docKey{t.TopicId, t.DocId}
+		if _, ok := byDoc[k]; !ok {
+			byDoc[k] = map[int64][]Tag{}
+		}
+		byDoc[k][t.UserId] = append(byDoc[k][t.UserId], t)
+	}
+
+	overall := map[int64]*extractCounts{}
+	report := &ExtractReport{Topics: []TopicExtractCoverage{}, Assessors: []ExtractCoverage{}}
+	for id, topic := range i.topics {
+		topicId, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+		cited := topic.citedExtracts()
+		t := TopicExtractCoverage{TopicId: id, Assessors: []ExtractCoverage{}}
+		counts := map[int64]*extractCounts{}
+		total := extractCounts{}
+		for doc, extracts := range cited {
+			assessors := judged[docKey{topicId, doc}]
+			if len(assessors) == 0 {
+				continue
+			}
+			dec, err := i.docs.Get(strconv.FormatInt(doc, 10))
+			if err == errDocumentNotFound {
+				t.Unlocated += len(extracts)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			text := newDocText(dec.Html)
+			tokens := textTokens(text.text)
+
+			// Token ranges of each located extract.
+			spans := [][2]int{}
+			for _, x := range extracts {
+				start, end, ok := text.anchor(x, 0, 0)
+				if !ok {
+					t.Unlocated++
+					continue
+				}
+				s := sort.Search(len(tokens), func(n int) bool { return tokens[n][1] > start })
+				e := sort.Search(len(tokens), func(n int) bool { return tokens[n][0] >= end })
+				if s < e {
+					spans = append(spans, [2]int{s, e})
+				}
+			}
+			if len(spans) == 0 {
+				continue
+			}
+			t.CitedDocs++
+
+			for _, u := range assessors {
+				covered := taggedTokens(tokens, byDoc[docKey{topicId, doc}][u])
+				c := extractCounts{docs: 1, extracts: len(spans)}
+				inExtract := make([]bool, len(tokens))
+				for _, sp := range spans {
+					hit := false
+					for k := sp[0]; k < sp[1]; k++ {
+						hit = hit || covered[k]
+						inExtract[k] = true
+					}
+					if hit {
+						c.tagged++
+					}
+				}
+				for k := range tokens {
+					if inExtract[k] {
+						c.tokens++
+					}
+					if covered[k] {
+						c.tagTokens++
+					}
+					if inExtract[k] && covered[k] {
+						c.covered++
+					}
+				}
+				if _, ok := counts[u]; !ok {
+					counts[u] = &extractCounts{}
+				}
+				if _, ok := overall[u]; !ok {
+					overall[u] = &extractCounts{}
+				}
+				counts[u].add(c)
+				overall[u].add(c)
+				total.add(c)
+			}
+		}
+		if t.CitedDocs == 0 && t.Unlocated == 0 {
+			continue
+		}
+		t.Coverage = ratio(total.covered, total.tokens)
+		for u, c := range counts {
+			t.Assessors = append(t.Assessors, c.coverage(names[u]))
+		}
+		sortCoverage(t.Assessors)
+		report.Topics = append(report.Topics, t)
+	}
+
+	for u, c := range overall {
+		report.Assessors = append(report.Assessors, c.coverage(names[u]))
+	}
+	sortCoverage(report.Assessors)
+	sort.Slice(report.Topics, func(a, b int) bool {
+		x, _ := strconv.Atoi(report.Topics[a].TopicId)
+		y, _ := strconv.Atoi(report.Topics[b].TopicId)
+		return x < y
+	})
+	return report, nil
+}
+
+func sortCoverage(c []ExtractCoverage) {
+	sort.Slice(c, func(x, y int) bool { return c[x].Assessor < c[y].Assessor })
+}
+
+// GET /admin/extracts
+func extractReportHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	report, err := i.extractReport()
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(report)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
@@ -3,13 +3,12 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/mux"
-
-	lexes "github.com/danlocke/lexes/parser"
 )
 
 type TopicData struct {
@@ -20,6 +19,17 @@ type TopicData struct {
 
 }
 
+// Adjudicators get the topic page in adjudication mode.
+type topicPage struct {
+
+	Topic
+
+	Adjudicate bool
+
+	TagCategories []string
+
+}
+
 type queryRes struct {
 
 	Text string
@@ -127,14 +137,14 @@ func decisionHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int,
 	}
 	log.Printf("user %d - handling decision data - %s", auth, docId)
 
-	getRes, err := i.es.Get(i.searchIndex, i.docType, docId)
-	if err != nil {
-		return 500, err
+	dec, err := i.docs.Get(docId)
+	if err == errDocumentNotFound {
+		return 404, err
 	}
-	api, err := elasticGetToApiResponse(getRes)
 	if err != nil {
 		return 500, err
 	}
+	api := ApiGetResponse(*dec)
 	buff, err := json.Marshal(api)
 	if err != nil {
 		return 500, err
@@ -168,7 +178,12 @@ func topicIndexDataHandler(i *Instance, w http.ResponseWriter, r *http.Request)
 	}
 	log.Printf("user %d - handling topic index data.", auth)
 
-	list, err := i.getTopicList(auth)
+	role, err := dbGetUserRole(i.db, auth)
+	if err != nil {
+		return 500, err
+	}
+
+	list, err := i.getTopicList(auth, role != roleAssessor)
 	if err != nil {
 		return 500, err
 	}
@@ -193,8 +208,24 @@ func topicViewHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int,
 	topicId, ok := vars["topicId"]; if !ok {
 		return 400, nil
 	}
+	ok, err = i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
+	role, err := dbGetUserRole(i.db, auth)
+	if err != nil {
+		return 500, err
+	}
 
-	topic := i.getTopic(topicId)
+	topic := topicPage{
+		Topic: i.getTopic(topicId),
+		Adjudicate: role == roleAdjudicator,
+		TagCategories: i.tagCategories(),
+	}
 
 	log.Printf("user %d - handling topic - %s.\n", auth, topicId)
 	i.templates["topic"].Execute(w, topic)
@@ -217,15 +248,22 @@ func topicDecisionHandler(i *Instance, w http.ResponseWriter, r *http.Request) (
 		return 400, nil
 	}
 	log.Printf("user %d - requested decision data for topic - %s", auth, topicId)
-
-	getRes, err := i.es.Get(i.searchIndex, i.docType, docId)
+	ok, err = i.canViewTopic(auth, topicId)
 	if err != nil {
 		return 500, err
 	}
-	api, err := elasticGetToApiResponse(getRes)
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
+	dec, err := i.docs.Get(docId)
+	if err == errDocumentNotFound {
+		return 404, err
+	}
 	if err != nil {
 		return 500, err
 	}
+	api := ApiGetResponse(*dec)
 	assessed, err := dbGetAssessedPerTopic(i.db, auth, topicId)
 	if err != nil {
 		return 500, err
@@ -245,6 +283,37 @@ func topicDecisionHandler(i *Instance, w http.ResponseWriter, r *http.Request) (
 	return 200, nil
 }
 
+// The user's pool for the topic, with control documents, and ranked if
+// active learning is on. With extend set any searches not yet pooled are
+// pooled first.
+func (i *Instance) topicHits(userId int64, topicId string, extend bool) ([]queryRes, []ApiCaseResponse, error) {
+	var qrys []queryRes
+	var hits []ApiCaseResponse
+	var err error
+
+	if i.byList {
+		qrys, hits, err = i.elasticTopicDocListQuery(userId, topicId)
+	} else {
+		qrys, hits, err = i.topicPool(userId, topicId, extend)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hits, err = i.addControls(userId, topicId, hits)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if i.config.Topics.ActiveLearning {
+		hits, err = i.rankUnjudged(topicId, hits)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return qrys, hits, nil
+}
+
 func topicDataHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
 	auth, err := i.authed(r)
 	if err != nil {
@@ -259,50 +328,17 @@ func topicDataHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int,
 	}
 	log.Printf("user %d - requested topic data - %s.\n", auth, topicId)
 
-	topic := i.getTopic(topicId)
-
-	var qrys []queryRes
-	var hits []ApiCaseResponse
-
-	if i.byList {
-		qrys, hits, err = i.elasticTopicDocListQuery(auth, topicId)
-		if err != nil {
-			return 500, err
-		}
-	} else {
-		queries := make([]map[string]interface{}, 0)
-
-		queries = append(queries, createTextQuery(topic.Topic, "html"))
-		queryString := []string{topic.Topic}
-
-		for _, e := range topic.Extracts {
-			for _, q := range []string{e.CitingSentence, e.CitingParagraph}{ // will need to change this to fix for new topic struct...
-				queries = append(queries, createTextQuery(q, "html"))
-				queryString = append(queryString, q)
-			}
-
-			queries = append(queries, e.EsQuery...)
-			queryString = append(queryString, e.Query...)
-		}
-
-		qry, err := dbGetUserQueries(i.db, topicId, auth)
-		if err != nil {
-			return 500, err
-		}
-
-		for _, q := range qry {
-			lq, err := lexes.Parse(q, "html", nil, true, false)
-			if err != nil {
-				return 500, err
-			}
-			queries = append(queries, *lq)
-			queryString = append(queryString, q)
-		}
+	ok, err = i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
 
-		qrys, hits, err = i.elasticTopicQueryHits(auth, topicId, queryString, queries)
-		if err != nil {
-			return 500, err
-		}
+	qrys, hits, err := i.topicHits(auth, topicId, true)
+	if err != nil {
+		return 500, err
 	}
 
 	t := TopicData {
@@ -0,0 +1,790 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An in memory inverted index over the local store, evaluating the subset of
+// the Elasticsearch query DSL produced by lexes and createTextQuery: match,
+// match_phrase, term, prefix, wildcard, bool, constant_score, ids, match_all
+// and the span queries (span_term, span_multi, span_or, span_near) used for
+// the w/n, w/s and w/p operators. Scoring is BM25 for term queries, spans
+// score by their number of matches.
+
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+var tokenRe = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// Fields searched as the decision text.
+var textFields = map[string]bool{"html": true, "plain_text": true, "_all": true}
+
+// Limit on span combinations tried per document, proximity queries over very
+// common terms are otherwise quadratic.
+const maxSpanCombinations = 100000
+
+const (
+	bm25K1 float64 = 1.2
+	bm25B float64 = 0.75
+)
+
+type posting struct {
+
+	doc int
+
+	positions []int
+
+}
+
+type fieldIndex struct {
+
+	postings map[string][]posting
+
+	// Sorted, for prefix and wildcard expansion.
+	terms []string
+
+	lengths []int
+
+	avgLength float64
+
+}
+
+type invertedIndex struct {
+
+	// Document number to id.
+	ids []string
+
+	byId map[string]int
+
+	fields map[string]*fieldIndex
+
+}
+
+// Doc number to score.
+type scored map[int]float64
+
+type span struct {
+
+	start int
+
+	end int
+
+}
+
+// Doc number to matching spans.
+type spanSet map[int][]span
+
+func analyze(text string) []string {
+	tokens := tokenRe.FindAllString(text, -1)
+	for j := range tokens {
+		tokens[j] = strings.ToLower(tokens[j])
+	}
+	return tokens
+}
+
+func htmlText(s string) string {
+	return html.UnescapeString(tagRe.ReplaceAllString(s, " "))
+}
+
+func buildIndex(order []string, docs map[string]Decision) *invertedIndex {
+	x := &invertedIndex{
+		ids: order,
+		byId: map[string]int{},
+		fields: map[string]*fieldIndex{
+			"html": {postings: map[string][]posting{}},
+			"name": {postings: map[string][]posting{}},
+		},
+	}
+	for n, id := range order {
+		x.byId[id] = n
+		d := docs[id]
+		x.fields["html"].add(n, analyze(htmlText(d.Html)))
+		x.fields["name"].add(n, analyze(d.CaseName))
+	}
+	for _, f := range x.fields {
+		f.finish()
+	}
+	return x
+}
+
+func (f *fieldIndex) add(doc int, tokens []string) {
+	positions := map[string][]int{}
+	for p, t := range tokens {
+		positions[t] = append(positions[t], p)
+	}
+	for t, p := range positions {
+		f.postings[t] = append(f.postings[t], posting{doc, p})
+	}
+	for len(f.lengths) < doc {
+		f.lengths = append(f.lengths, 0)
+	}
+	f.lengths = append(f.lengths, len(tokens))
+}
+
+func (f *fieldIndex) finish() {
+	f.terms = make([]string, 0, len(f.postings))
+	for t := range f.postings {
+		f.terms = append(f.terms, t)
+	}
+	sort.Strings(f.terms)
+	total := 0
+	for _, l := range f.lengths {
+		total += l
+	}
+	if len(f.lengths) > 0 {
+		f.avgLength = float64(total) / float64(len(f.lengths))
+	}
+}
+
+func (x *invertedIndex) field(name string) (*fieldIndex, error) {
+	if textFields[name] {
+		name = "html"
+	}
+	f, ok := x.fields[name]
+	if !ok {
+		return nil, fmt.Errorf("Local index has no field %s", name)
+	}
+	return f, nil
+}
+
+// Terms ------------------------------------------------------------------------
+
+func (f *fieldIndex) prefixTerms(prefix string) []string {
+	start := sort.SearchStrings(f.terms, prefix)
+	res := []string{}
+	for j := start; j < len(f.terms) && strings.HasPrefix(f.terms[j], prefix); j++ {
+		res = append(res, f.terms[j])
+	}
+	return res
+}
+
+func (f *fieldIndex) wildcardTerms(pattern string) ([]string, error) {
+	literal := pattern
+	if k := strings.IndexAny(pattern, "*?"); k >= 0 {
+		literal = pattern[:k]
+	}
+	re, err := regexp.Compile("^" + strings.Replace(strings.Replace(regexp.QuoteMeta(pattern),
+		`\*`, ".*", -1), `\?`, ".", -1) + "$")
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, t := range f.prefixTerms(literal) {
+		if re.MatchString(t) {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+func (f *fieldIndex) bm25(terms []string) scored {
+	res := scored{}
+	n := float64(len(f.lengths))
+	for _, t := range terms {
+		ps := f.postings[t]
+		if len(ps) == 0 {
+			continue
+		}
+		df := float64(len(ps))
+		idf := math.Log(1 + (n - df + 0.5) / (df + 0.5))
+		for _, p := range ps {
+			tf := float64(len(p.positions))
+			norm := 1 - bm25B + bm25B * float64(f.lengths[p.doc]) / f.avgLength
+			res[p.doc] += idf * tf * (bm25K1 + 1) / (tf + bm25K1 * norm)
+		}
+	}
+	return res
+}
+
+func (f *fieldIndex) termSpans(terms []string) spanSet {
+	res := spanSet{}
+	for _, t := range terms {
+		for _, p := range f.postings[t] {
+			for _, pos := range p.positions {
+				res[p.doc] = append(res[p.doc], span{pos, pos + 1})
+			}
+		}
+	}
+	for d := range res {
+		sortSpans(res[d])
+	}
+	return res
+}
+
+func sortSpans(s []span) {
+	sort.Slice(s, func(a, b int) bool {
+		if s[a].start != s[b].start {
+			return s[a].start < s[b].start
+		}
+		return s[a].end < s[b].end
+	})
+}
+
+// DSL helpers -------------------------------------------------------------------
+
+// The single {field: value} pair of a leaf query.
+func fieldValue(raw json.RawMessage) (string, json.RawMessage, error) {
+	var m map[string]json.RawMessage
+	err := json.Unmarshal(raw, &m)
+	if err != nil {
+		return "", nil, err
+	}
+	for k, v := range m {
+		if k == "boost" {
+			continue
+		}
+		return k, v, nil
+	}
+	return "", nil, fmt.Errorf("Query has no field: %s", raw)
+}
+
+// A leaf value given either directly or as {"value": ...} / {"query": ...}.
+type leafValue struct {
+
+	Value string
+
+	Operator string
+
+	Slop int
+
+}
+
+func parseLeafValue(raw json.RawMessage) (leafValue, error) {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return leafValue{Value: s}, nil
+	}
+	var n json.Number
+	if json.Unmarshal(raw, &n) == nil {
+		return leafValue{Value: n.String()}, nil
+	}
+	var o struct {
+		Value interface{} `json:"value"`
+		Query interface{} `json:"query"`
+		Operator string `json:"operator"`
+		Slop int `json:"slop"`
+	}
+	err := json.Unmarshal(raw, &o)
+	if err != nil {
+		return leafValue{}, err
+	}
+	v := o.Value
+	if v == nil {
+		v = o.Query
+	}
+	return leafValue{Value: fmt.Sprint(v), Operator: strings.ToLower(o.Operator), Slop: o.Slop}, nil
+}
+
+// Bool clauses are either a single query or a list of queries.
+func clauses(raw json.RawMessage) ([]map[string]json.RawMessage, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var list []map[string]json.RawMessage
+	if json.Unmarshal(raw, &list) == nil {
+		return list, nil
+	}
+	var one map[string]json.RawMessage
+	err := json.Unmarshal(raw, &one)
+	if err != nil {
+		return nil, err
+	}
+	return []map[string]json.RawMessage{one}, nil
+}
+
+// Evaluation ---------------------------------------------------------------------
+
+func (x *invertedIndex) all() scored {
+	res := scored{}
+	for n := range x.ids {
+		res[n] = 1
+	}
+	return res
+}
+
+// Evaluates a query object, each key in it is a query and all must match.
+func (x *invertedIndex) eval(q map[string]json.RawMessage) (scored, error) {
+	if len(q) == 0 {
+		return x.all(), nil
+	}
+	var res scored
+	for k, v := range q {
+		r, err := x.evalQuery(k, v)
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = r
+		} else {
+			res = intersect(res, r)
+		}
+	}
+	return res, nil
+}
+
+func (x *invertedIndex) evalQuery(kind string, raw json.RawMessage) (scored, error) {
+	switch kind {
+		case "match_all":
+			return x.all(), nil
+
+		case "ids":
+			var ids struct{ Values []json.Number `json:"values"` }
+			err := json.Unmarshal(raw, &ids)
+			if err != nil {
+				return nil, err
+			}
+			res := scored{}
+			for _, id := range ids.Values {
+				if n, ok := x.byId[id.String()]; ok {
+					res[n] = 1
+				}
+			}
+			return res, nil
+
+		case "match", "term", "prefix", "wildcard":
+			name, value, err := fieldValue(raw)
+			if err != nil {
+				return nil, err
+			}
+			f, err := x.field(name)
+			if err != nil {
+				return nil, err
+			}
+			v, err := parseLeafValue(value)
+			if err != nil {
+				return nil, err
+			}
+			switch kind {
+				case "match":
+					terms := analyze(v.Value)
+					// No terms, ie. only punctuation, nothing matches.
+					if len(terms) == 0 {
+						return scored{}, nil
+					}
+					if v.Operator == "and" {
+						res := scored(nil)
+						for _, t := range terms {
+							r := f.bm25([]string{t})
+							if res == nil {
+								res = r
+							} else {
+								res = intersect(res, r)
+							}
+						}
+						return res, nil
+					}
+					return f.bm25(terms), nil
+				case "term":
+					return f.bm25([]string{strings.ToLower(v.Value)}), nil
+				case "prefix":
+					return f.bm25(f.prefixTerms(strings.ToLower(v.Value))), nil
+				default:
+					terms, err := f.wildcardTerms(strings.ToLower(v.Value))
+					if err != nil {
+						return nil, err
+					}
+					return f.bm25(terms), nil
+			}
+
+		case "match_phrase":
+			name, value, err := fieldValue(raw)
+			if err != nil {
+				return nil, err
+			}
+			f, err := x.field(name)
+			if err != nil {
+				return nil, err
+			}
+			v, err := parseLeafValue(value)
+			if err != nil {
+				return nil, err
+			}
+			sets := []spanSet{}
+			for _, t := range analyze(v.Value) {
+				sets = append(sets, f.termSpans([]string{t}))
+			}
+			return spanScores(nearSpans(sets, v.Slop, true)), nil
+
+		case "span_term", "span_multi", "span_or", "span_near":
+			_, s, err := x.evalSpan(kind, raw)
+			if err != nil {
+				return nil, err
+			}
+			return spanScores(s), nil
+
+		case "constant_score":
+			var c struct{ Filter map[string]json.RawMessage `json:"filter"` }
+			err := json.Unmarshal(raw, &c)
+			if err != nil {
+				return nil, err
+			}
+			res, err := x.eval(c.Filter)
+			if err != nil {
+				return nil, err
+			}
+			for d := range res {
+				res[d] = 1
+			}
+			return res, nil
+
+		case "bool":
+			return x.evalBool(raw)
+	}
+	return nil, fmt.Errorf("Local index does not support %s queries", kind)
+}
+
+func (x *invertedIndex) evalBool(raw json.RawMessage) (scored, error) {
+	var b struct {
+		Must json.RawMessage `json:"must"`
+		Should json.RawMessage `json:"should"`
+		MustNot json.RawMessage `json:"must_not"`
+		Filter json.RawMessage `json:"filter"`
+		MinimumShouldMatch json.RawMessage `json:"minimum_should_match"`
+	}
+	err := json.Unmarshal(raw, &b)
+	if err != nil {
+		return nil, err
+	}
+
+	var res scored
+	required := false
+	for g, group := range []json.RawMessage{b.Must, b.Filter} {
+		cs, err := clauses(group)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cs {
+			r, err := x.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			// Filters do not score.
+			if g == 1 {
+				for d := range r {
+					r[d] = 0
+				}
+			}
+			required = true
+			if res == nil {
+				res = r
+			} else {
+				res = intersect(res, r)
+			}
+		}
+	}
+
+	should, err := clauses(b.Should)
+	if err != nil {
+		return nil, err
+	}
+	minShould := 0
+	if len(b.MinimumShouldMatch) > 0 {
+		minShould, err = minimumShouldMatch(b.MinimumShouldMatch, len(should))
+		if err != nil {
+			return nil, err
+		}
+	} else if !required && len(should) > 0 {
+		minShould = 1
+	}
+	if len(should) > 0 {
+		sum := scored{}
+		matched := map[int]int{}
+		for _, c := range should {
+			r, err := x.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			for d, s := range r {
+				sum[d] += s
+				matched[d]++
+			}
+		}
+		if res == nil {
+			res = scored{}
+			for d, s := range sum {
+				if matched[d] >= minShould {
+					res[d] = s
+				}
+			}
+		} else {
+			for d := range res {
+				if matched[d] < minShould {
+					delete(res, d)
+					continue
+				}
+				res[d] += sum[d]
+			}
+		}
+	}
+	if res == nil {
+		res = x.all()
+	}
+
+	mustNot, err := clauses(b.MustNot)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range mustNot {
+		r, err := x.eval(c)
+		if err != nil {
+			return nil, err
+		}
+		for d := range r {
+			delete(res, d)
+		}
+	}
+	return res, nil
+}
+
+// Clauses required of n should clauses, given as a count or percentage, either
+// of which may be negative for the number that may be missing, ie. 2, -1, 75%
+// or -25%.
+func minimumShouldMatch(raw json.RawMessage, n int) (int, error) {
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		var m json.Number
+		err := json.Unmarshal(raw, &m)
+		if err != nil {
+			return 0, err
+		}
+		s = m.String()
+	}
+	s = strings.TrimSpace(s)
+	missing := strings.HasPrefix(s, "-")
+	v := strings.TrimPrefix(s, "-")
+	m, err := strconv.Atoi(strings.TrimSuffix(v, "%"))
+	if err != nil || m < 0 {
+		return 0, fmt.Errorf("Local index does not support minimum_should_match %q", s)
+	}
+	if strings.HasSuffix(v, "%") {
+		m = n * m / 100
+	}
+	if missing {
+		m = n - m
+	}
+	if m < 0 {
+		m = 0
+	}
+	return m, nil
+}
+
+func intersect(a, b scored) scored {
+	res := scored{}
+	for d, s := range a {
+		if t, ok := b[d]; ok {
+			res[d] = s + t
+		}
+	}
+	return res
+}
+
+func spanScores(s spanSet) scored {
+	res := scored{}
+	for d, spans := range s {
+		if len(spans) > 0 {
+			res[d] = float64(len(spans))
+		}
+	}
+	return res
+}
+
+// Spans ---------------------------------------------------------------------------
+
+// Returns the field the span query is over and its matches.
+func (x *invertedIndex) evalSpan(kind string, raw json.RawMessage) (string, spanSet, error) {
+	switch kind {
+		case "span_term":
+			name, value, err := fieldValue(raw)
+			if err != nil {
+				return "", nil, err
+			}
+			f, err := x.field(name)
+			if err != nil {
+				return "", nil, err
+			}
+			v, err := parseLeafValue(value)
+			if err != nil {
+				return "", nil, err
+			}
+			return name, f.termSpans([]string{strings.ToLower(v.Value)}), nil
+
+		case "span_multi":
+			var m struct{ Match map[string]json.RawMessage `json:"match"` }
+			err := json.Unmarshal(raw, &m)
+			if err != nil {
+				return "", nil, err
+			}
+			for k, inner := range m.Match {
+				name, value, err := fieldValue(inner)
+				if err != nil {
+					return "", nil, err
+				}
+				f, err := x.field(name)
+				if err != nil {
+					return "", nil, err
+				}
+				v, err := parseLeafValue(value)
+				if err != nil {
+					return "", nil, err
+				}
+				var terms []string
+				switch k {
+					case "prefix":
+						terms = f.prefixTerms(strings.ToLower(v.Value))
+					case "wildcard":
+						terms, err = f.wildcardTerms(strings.ToLower(v.Value))
+						if err != nil {
+							return "", nil, err
+						}
+					case "term":
+						terms = []string{strings.ToLower(v.Value)}
+					default:
+						return "", nil, fmt.Errorf("Local index does not support span_multi %s", k)
+				}
+				return name, f.termSpans(terms), nil
+			}
+			return "", nil, fmt.Errorf("Empty span_multi query")
+
+		case "span_or", "span_near":
+			var n struct {
+				Clauses []map[string]json.RawMessage `json:"clauses"`
+				Slop int `json:"slop"`
+				InOrder bool `json:"in_order"`
+			}
+			err := json.Unmarshal(raw, &n)
+			if err != nil {
+				return "", nil, err
+			}
+			field := ""
+			sets := []spanSet{}
+			for _, c := range n.Clauses {
+				for k, v := range c {
+					name, s, err := x.evalSpan(k, v)
+					if err != nil {
+						return "", nil, err
+					}
+					field = name
+					sets = append(sets, s)
+				}
+			}
+			if kind == "span_or" {
+				res := spanSet{}
+				for _, s := range sets {
+					for d, spans := range s {
+						res[d] = append(res[d], spans...)
+					}
+				}
+				for d := range res {
+					sortSpans(res[d])
+				}
+				return field, res, nil
+			}
+			return field, nearSpans(sets, n.Slop, n.InOrder), nil
+	}
+	return "", nil, fmt.Errorf("Local index does not support %s span queries", kind)
+}
+
+// Matches of all clauses within slop unmatched positions of each other,
+// in clause order if inOrder.
+func nearSpans(sets []spanSet, slop int, inOrder bool) spanSet {
+	res := spanSet{}
+	if len(sets) == 0 {
+		return res
+	}
+	for d := range sets[0] {
+		lists := make([][]span, len(sets))
+		ok := true
+		for j, s := range sets {
+			lists[j] = s[d]
+			if len(lists[j]) == 0 {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		seen := map[span]bool{}
+		tries := 0
+		var walk func(j, minStart, maxEnd, length, lastEnd int, used []span)
+		walk = func(j, minStart, maxEnd, length, lastEnd int, used []span) {
+			if tries > maxSpanCombinations {
+				return
+			}
+			tries++
+			if j == len(lists) {
+				if maxEnd - minStart - length <= slop && !seen[span{minStart, maxEnd}] {
+					seen[span{minStart, maxEnd}] = true
+					res[d] = append(res[d], span{minStart, maxEnd})
+				}
+				return
+			}
+			for _, s := range lists[j] {
+				if inOrder && s.start < lastEnd {
+					continue
+				}
+				if overlaps(s, used) {
+					continue
+				}
+				lo, hi := minStart, maxEnd
+				if j == 0 || s.start < lo {
+					lo = s.start
+				}
+				if j == 0 || s.end > hi {
+					hi = s.end
+				}
+				// The gap can shrink by at most the length of the spans still
+				// to be placed, give up once it cannot.
+				if hi - lo - (length + s.end - s.start) > slop + (len(lists) - j - 1) * maxSpanLength(lists[j+1:]) {
+					continue
+				}
+				walk(j + 1, lo, hi, length + s.end - s.start, s.end, append(used, s))
+			}
+		}
+		walk(0, 0, 0, 0, 0, nil)
+		sortSpans(res[d])
+	}
+	return res
+}
+
+func overlaps(s span, used []span) bool {
+	for _, u := range used {
+		if s.start < u.end && u.start < s.end {
+			return true
+		}
+	}
+	return false
+}
+
+func maxSpanLength(lists [][]span) int {
+	m := 0
+	for _, l := range lists {
+		for _, s := range l {
+			if s.end - s.start > m {
+				m = s.end - s.start
+			}
+		}
+	}
+	return m
+}
+
+// Ranks matching documents by score, ties in load order.
+func (x *invertedIndex) rank(s scored) []int {
+	docs := make([]int, 0, len(s))
+	for d := range s {
+		docs = append(docs, d)
+	}
+	sort.Slice(docs, func(a, b int) bool {
+		if s[docs[a]] != s[docs[b]] {
+			return s[docs[a]] > s[docs[b]]
+		}
+		return docs[a] < docs[b]
+	})
+	return docs
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testIndex() *invertedIndex {
+	return buildIndex([]string{"1", "2", "3", "4"}, map[string]Decision{
+		"1": {CaseName: "Smith v. Jones", Html: "<p>The court held the contract <i>void</i> for mistake.</p>"},
+		"2": {CaseName: "Brown v. Smith", Html: "<p>The contract was valid. The court found no mistake.</p>"},
+		"3": {CaseName: "Green v. White", Html: "<p>Negligence claims require a duty of care.</p>"},
+		"4": {CaseName: "Black v. Grey", Html: "<p>The negligent driver breached the duty.</p>"},
+	})
+}
+
+// Ids of the documents matching query, sorted.
+func matching(t *testing.T, x *invertedIndex, query string) []string {
+	var q map[string]json.RawMessage
+	err := json.Unmarshal([]byte(query), &q)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	s, err := x.eval(q)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	ids := []string{}
+	for n := range s {
+		ids = append(ids, x.ids[n])
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestEval(t *testing.T) {
+	x := testIndex()
+	tests := []struct {
+
+		name string
+
+		query string
+
+		want []string
+
+	}{
+		{"match_all", `{"match_all": {}}`, []string{"1", "2", "3", "4"}},
+		{"empty", `{}`, []string{"1", "2", "3", "4"}},
+		{"ids", `{"ids": {"values": [1, "3", 9]}}`, []string{"1", "3"}},
+
+		{"match", `{"match": {"html": "contract"}}`, []string{"1", "2"}},
+		{"match or", `{"match": {"html": {"query": "contract negligence"}}}`, []string{"1", "2", "3"}},
+		{"match and", `{"match": {"html": {"query": "court mistake", "operator": "and"}}}`, []string{"1", "2"}},
+		{"match and none", `{"match": {"html": {"query": "contract negligence", "operator": "and"}}}`, []string{}},
+		{"match punctuation", `{"match": {"html": "..."}}`, []string{}},
+		{"match punctuation and", `{"match": {"html": {"query": "!!", "operator": "and"}}}`, []string{}},
+		{"match markup", `{"match": {"html": "p"}}`, []string{}},
+		{"match alias", `{"match": {"_all": "void"}}`, []string{"1"}},
+		{"match name", `{"match": {"name": "smith"}}`, []string{"1", "2"}},
+
+		{"term", `{"term": {"html": "Court"}}`, []string{"1", "2"}},
+		{"term value", `{"term": {"html": {"value": "duty"}}}`, []string{"3", "4"}},
+		{"prefix", `{"prefix": {"html": "neglig"}}`, []string{"3", "4"}},
+		{"wildcard star", `{"wildcard": {"html": "neg*ce"}}`, []string{"3"}},
+		{"wildcard question", `{"wildcard": {"html": "d?ty"}}`, []string{"3", "4"}},
+
+		{"match_phrase", `{"match_phrase": {"html": "contract void"}}`, []string{"1"}},
+		{"match_phrase order", `{"match_phrase": {"html": "void contract"}}`, []string{}},
+		{"match_phrase slop", `{"match_phrase": {"html": {"query": "court contract", "slop": 2}}}`, []string{"1"}},
+
+		{"span_term", `{"span_term": {"html": "mistake"}}`, []string{"1", "2"}},
+		{"span_multi prefix", `{"span_multi": {"match": {"prefix": {"html": {"value": "neglig"}}}}}`, []string{"3", "4"}},
+		{"span_multi wildcard", `{"span_multi": {"match": {"wildcard": {"html": {"value": "v*d"}}}}}`, []string{"1", "2"}},
+		{"span_or", `{"span_or": {"clauses": [{"span_term": {"html": "void"}}, {"span_term": {"html": "care"}}]}}`, []string{"1", "3"}},
+		{"span_near in order", `{"span_near": {"clauses": [{"span_term": {"html": "court"}}, {"span_term": {"html": "contract"}}], "slop": 2, "in_order": true}}`, []string{"1"}},
+		{"span_near unordered", `{"span_near": {"clauses": [{"span_term": {"html": "court"}}, {"span_term": {"html": "contract"}}], "slop": 3, "in_order": false}}`, []string{"1", "2"}},
+		{"span_near slop", `{"span_near": {"clauses": [{"span_term": {"html": "court"}}, {"span_term": {"html": "contract"}}], "slop": 1, "in_order": false}}`, []string{}},
+		{"span_near multi", `{"span_near": {"clauses": [{"span_multi": {"match": {"prefix": {"html": {"value": "neglig"}}}}}, {"span_term": {"html": "duty"}}], "slop": 3, "in_order": true}}`, []string{"3", "4"}},
+		{"span_near multi slop", `{"span_near": {"clauses": [{"span_multi": {"match": {"prefix": {"html": {"value": "neglig"}}}}}, {"span_term": {"html": "duty"}}], "slop": 2, "in_order": true}}`, []string{}},
+		{"span_near nested", `{"span_near": {"clauses": [{"span_or": {"clauses": [{"span_term": {"html": "valid"}}, {"span_term": {"html": "void"}}]}}, {"span_term": {"html": "mistake"}}], "slop": 5, "in_order": true}}`, []string{"1", "2"}},
+
+		{"bool must", `{"bool": {"must": [{"term": {"html": "court"}}, {"term": {"html": "void"}}]}}`, []string{"1"}},
+		{"bool must single", `{"bool": {"must": {"term": {"html": "duty"}}}}`, []string{"3", "4"}},
+		{"bool must_not", `{"bool": {"must": {"term": {"html": "court"}}, "must_not": {"term": {"html": "void"}}}}`, []string{"2"}},
+		{"bool only must_not", `{"bool": {"must_not": {"term": {"html": "the"}}}}`, []string{"3"}},
+		{"bool filter", `{"bool": {"filter": {"term": {"html": "mistake"}}, "must": {"term": {"html": "valid"}}}}`, []string{"2"}},
+		{"bool should", `{"bool": {"should": [{"term": {"html": "void"}}, {"term": {"html": "care"}}]}}`, []string{"1", "3"}},
+		{"bool should optional", `{"bool": {"must": {"term": {"html": "duty"}}, "should": {"term": {"html": "care"}}}}`, []string{"3", "4"}},
+		{"bool minimum_should_match", `{"bool": {"should": [{"term": {"html": "contract"}}, {"term": {"html": "court"}}, {"term": {"html": "negligence"}}], "minimum_should_match": 2}}`, []string{"1", "2"}},
+		{"bool minimum_should_match percent", `{"bool": {"should": [{"term": {"html": "contract"}}, {"term": {"html": "court"}}, {"term": {"html": "negligence"}}], "minimum_should_match": "75%"}}`, []string{"1", "2"}},
+		{"bool minimum_should_match negative", `{"bool": {"should": [{"term": {"html": "contract"}}, {"term": {"html": "court"}}, {"term": {"html": "negligence"}}], "minimum_should_match": "-2"}}`, []string{"1", "2", "3"}},
+		{"bool minimum_should_match all", `{"bool": {"should": [{"term": {"html": "contract"}}, {"term": {"html": "court"}}, {"term": {"html": "negligence"}}], "minimum_should_match": 3}}`, []string{}},
+
+		{"constant_score", `{"constant_score": {"filter": {"term": {"html": "care"}}}}`, []string{"3"}},
+		{"several", `{"term": {"html": "court"}, "prefix": {"html": "val"}}`, []string{"2"}},
+	}
+	for _, test := range tests {
+		got := matching(t, x, test.query)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	x := testIndex()
+	for _, query := range []string{
+		`{"fuzzy": {"html": "court"}}`,
+		`{"match": {"citation": "court"}}`,
+		`{"span_multi": {"match": {"fuzzy": {"html": {"value": "court"}}}}}`,
+		`{"bool": {"should": {"term": {"html": "court"}}, "minimum_should_match": "most"}}`,
+	} {
+		var q map[string]json.RawMessage
+		err := json.Unmarshal([]byte(query), &q)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		_, err = x.eval(q)
+		if err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	x := testIndex()
+	s, err := x.eval(map[string]json.RawMessage{"bool": json.RawMessage(`{"must": {"term": {"html": "duty"}}, "should": {"term": {"html": "care"}}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranked := []string{}
+	for _, n := range x.rank(s) {
+		ranked = append(ranked, x.ids[n])
+	}
+	if !reflect.DeepEqual(ranked, []string{"3", "4"}) {
+		t.Errorf("got %v, want [3 4]", ranked)
+	}
+
+	// Ties keep load order.
+	ranked = []string{}
+	for _, n := range x.rank(x.all()) {
+		ranked = append(ranked, x.ids[n])
+	}
+	if !reflect.DeepEqual(ranked, []string{"1", "2", "3", "4"}) {
+		t.Errorf("got %v, want [1 2 3 4]", ranked)
+	}
+}
+
+func TestMinimumShouldMatch(t *testing.T) {
+	tests := []struct {
+
+		raw string
+
+		want int
+
+	}{
+		{`2`, 2},
+		{`"2"`, 2},
+		{`"-1"`, 2},
+		{`"75%"`, 2},
+		{`"-25%"`, 3},
+		{`"100%"`, 3},
+		{`"-5"`, 0},
+	}
+	for _, test := range tests {
+		got, err := minimumShouldMatch(json.RawMessage(test.raw), 3)
+		if err != nil {
+			t.Errorf("%s: %v", test.raw, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %d, want %d", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestPageHits(t *testing.T) {
+	hits := []SearchHit{{Id: "1"}, {Id: "2"}, {Id: "3"}}
+	n := func(v int) *int { return &v }
+	tests := []struct {
+
+		from *int
+
+		size *int
+
+		want int
+
+	}{
+		{nil, nil, 3},
+		{n(1), n(1), 1},
+		{n(2), n(5), 1},
+		{n(5), n(5), 0},
+		{n(-1), n(2), 2},
+		{n(0), n(-1), 0},
+	}
+	for _, test := range tests {
+		res := pageHits(hits, test.from, test.size, nil)
+		if res.Total != 3 || len(res.Hits) != test.want {
+			t.Errorf("from %v size %v: got %d of %d hits, want %d of 3", test.from, test.size, len(res.Hits), res.Total, test.want)
+		}
+	}
+}
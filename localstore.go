@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localStore serves decisions from a CourtListener opinion dump held in
+// memory, either a directory of .json/.jsonl files or a single file, and
+// searches them with an inverted index built on load.
+type localStore struct {
+
+	docs map[string]Decision
+
+	// Ids in load order, the order of match_all results.
+	order []string
+
+	index *invertedIndex
+
+}
+
+// The fields of a CourtListener opinion (or of this index) that make up a
+// Decision. Opinions from the API carry the case name and date on the
+// cluster, bulk exports that merge clusters use either spelling.
+type localDecision struct {
+
+	Id json.Number `json:"id"`
+
+	Name string `json:"name"`
+
+	CaseName string `json:"case_name"`
+
+	CaseNameCamel string `json:"caseName"`
+
+	DateFiled string `json:"date_filed"`
+
+	DateFiledCamel string `json:"dateFiled"`
+
+	Html string `json:"html"`
+
+	HtmlWithCitations string `json:"html_with_citations"`
+
+	HtmlLawbox string `json:"html_lawbox"`
+
+	HtmlColumbia string `json:"html_columbia"`
+
+	PlainText string `json:"plain_text"`
+
+	Court string `json:"court"`
+
+	CourtId string `json:"court_id"`
+
+	Citation json.RawMessage `json:"citation"`
+
+	Judges json.RawMessage `json:"judges"`
+
+	DocketNumber string `json:"docket_number"`
+
+	DocketNumberCamel string `json:"docketNumber"`
+
+	Precedential string `json:"precedential_status"`
+
+	Status string `json:"status"`
+
+}
+
+func (l localDecision) decision() Decision {
+	d := Decision{
+		Id: l.Id.String(),
+		CaseName: firstNonEmpty(l.Name, l.CaseName, l.CaseNameCamel),
+		DateFiled: firstNonEmpty(l.DateFiled, l.DateFiledCamel),
+		Html: firstNonEmpty(l.Html, l.HtmlWithCitations, l.HtmlLawbox, l.HtmlColumbia),
+		Court: firstNonEmpty(l.Court, l.CourtId),
+		DocketNumber: firstNonEmpty(l.DocketNumber, l.DocketNumberCamel),
+		Precedential: firstNonEmpty(l.Precedential, l.Status),
+	}
+	if len(l.Citation) > 0 {
+		d.Citation, _ = decodeStrings(l.Citation)
+	}
+	if len(l.Judges) > 0 {
+		d.Judges, _ = decodeStrings(l.Judges)
+	}
+	if d.Html == "" && l.PlainText != "" {
+		d.Html = "<pre>" + html.EscapeString(l.PlainText) + "</pre>"
+	}
+	return d
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func newLocalStore(path string) (*localStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("Local document store requires store.path")
+	}
+	s := &localStore{docs: map[string]Decision{}}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		err = s.loadFile(path)
+	} else {
+		err = filepath.Walk(path, func(p string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if f.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(p, ".json") || strings.HasSuffix(p, ".jsonl") {
+				return s.loadFile(p)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.index = buildIndex(s.order, s.docs)
+	log.Printf("local store - indexed %d decisions.\n", len(s.order))
+	return s, nil
+}
+
+func (s *localStore) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(path, ".jsonl") {
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 1024 * 1024), 256 * 1024 * 1024)
+		line := 0
+		for sc.Scan() {
+			line++
+			if len(strings.TrimSpace(sc.Text())) == 0 {
+				continue
+			}
+			var l localDecision
+			err = json.Unmarshal(sc.Bytes(), &l)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			s.add(l.decision())
+		}
+		return sc.Err()
+	}
+
+	var l localDecision
+	err = json.NewDecoder(f).Decode(&l)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	s.add(l.decision())
+	return nil
+}
+
+func (s *localStore) add(d Decision) {
+	if _, ok := s.docs[d.Id]; !ok {
+		s.order = append(s.order, d.Id)
+	}
+	s.docs[d.Id] = d
+}
+
+func (s *localStore) Get(id string) (*Decision, error) {
+	d, ok := s.docs[id]
+	if !ok {
+		return nil, errDocumentNotFound
+	}
+	return &d, nil
+}
+
+func (s *localStore) MultiGet(ids []string) ([]Decision, error) {
+	docs := make([]Decision, 0, len(ids))
+	for _, id := range ids {
+		if d, ok := s.docs[id]; ok {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+// Top level search request keys, anything else (ie. post_filter, aggs) would
+// change the results and is refused.
+var localRequestKeys = map[string]bool{
+	"from": true, "size": true, "_source": true, "query": true, "highlight": true,
+}
+
+// The part of a search request the local store understands.
+type localRequest struct {
+
+	From *int `json:"from"`
+
+	Size *int `json:"size"`
+
+	Source []string `json:"_source"`
+
+	Query map[string]json.RawMessage `json:"query"`
+
+}
+
+// Ranked hits for a search request.
+func (s *localStore) matches(query []byte) (*localRequest, []SearchHit, error) {
+	var keys map[string]json.RawMessage
+	err := json.Unmarshal(query, &keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k := range keys {
+		if !localRequestKeys[k] {
+			return nil, nil, fmt.Errorf("Local document store does not support %s in a search", k)
+		}
+	}
+
+	var req localRequest
+	err = json.Unmarshal(query, &req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scores, err := s.index.eval(req.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+	ranked := s.index.rank(scores)
+	hits := make([]SearchHit, len(ranked))
+	for j, n := range ranked {
+		id := s.index.ids[n]
+		hits[j] = SearchHit{Id: id, Score: scores[n], Decision: s.docs[id]}
+	}
+	return &req, hits, nil
+}
+
+func (s *localStore) Search(query []byte) (*SearchResult, error) {
+	req, hits, err := s.matches(query)
+	if err != nil {
+		return nil, err
+	}
+	return pageHits(hits, req.From, req.Size, req.Source), nil
+}
+
+func (s *localStore) Count(query []byte) (int64, error) {
+	_, hits, err := s.matches(query)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(hits)), nil
+}
+
+// Applies from, size (default 10 as in Elasticsearch, negative values taken as
+// 0) and _source filtering to ranked hits.
+func pageHits(hits []SearchHit, from, size *int, source []string) *SearchResult {
+	start, n := 0, 10
+	if from != nil && *from > 0 {
+		start = *from
+	}
+	if size != nil {
+		n = *size
+	}
+	if n < 0 {
+		n = 0
+	}
+	res := &SearchResult{Total: int64(len(hits)), Hits: []SearchHit{}}
+	if start > len(hits) {
+		return res
+	}
+	end := start + n
+	if end > len(hits) {
+		end = len(hits)
+	}
+	res.Hits = append(res.Hits, hits[start:end]...)
+
+	// Only the text is worth leaving out.
+	if source != nil {
+		keep := false
+		for _, f := range source {
+			keep = keep || f == "html"
+		}
+		for j := range res.Hits {
+			if !keep {
+				res.Hits[j].Decision.Html = ""
+			}
+		}
+	}
+	return res
+}
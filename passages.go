@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	passageFormatJSONL string = "jsonl"
+
+	// topic iteration doc_id start length grade, the iteration holds the
+	// tagger id.
+	passageFormatTrec string = "trec"
+)
+
+// A tag as passage relevance evidence, with the tagger's judgment of the
+// whole document.
+type passage struct {
+
+	TagId int `json:"tag_id"`
+
+	TopicId int64 `json:"topic_id"`
+
+	DocId int64 `json:"doc_id"`
+
+	// Character offsets into the decision's plain text, see doctext.go.
+	Start int64 `json:"start"`
+
+	End int64 `json:"end"`
+
+	Text string `json:"text"`
+
+	TaggerId int64 `json:"tagger_id"`
+
+	Tagger string `json:"tagger"`
+
+	Category string `json:"category"`
+
+	Note string `json:"note,omitempty"`
+
+	TagRelevance string `json:"tag_relevance,omitempty"`
+
+	DocRelevance string `json:"doc_relevance,omitempty"`
+
+	// The tag's grade, or if it has none the document's. -1 if neither is
+	// graded.
+	Grade int `json:"grade"`
+
+}
+
+type passageOptions struct {
+
+	// If empty then all topics.
+	Topics map[string]bool
+
+	// If non-zero then only this assessor's tags.
+	Assessor int64
+
+	// If empty then all categories.
+	Categories map[string]bool
+
+}
+
+func (i *Instance) passages(opts passageOptions) ([]passage, error) {
+	all, err := dbGetPassages(i.db)
+	if err != nil {
+		return nil, err
+	}
+	grades := i.grades()
+
+	res := make([]passage, 0, len(all))
+	for _, p := range all {
+		if len(opts.Topics) > 0 && !opts.Topics[strconv.FormatInt(p.TopicId, 10)] {
+			continue
+		}
+		if opts.Assessor != 0 && p.TaggerId != opts.Assessor {
+			continue
+		}
+		if len(opts.Categories) > 0 && !opts.Categories[p.Category] {
+			continue
+		}
+		p.Grade = -1
+		if g, ok := grades[p.TagRelevance]; ok {
+			p.Grade = g
+		} else if g, ok := grades[p.DocRelevance]; ok {
+			p.Grade = g
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func dbGetPassages(db *sql.DB) ([]passage, error) {
+	rows, err := db.Query(`SELECT t.tag_id, t.topic_id, t.doc_id, t.start_char, t.end_char, t.quote,
+		t.tagger, u.name, t.category, t.note, t.relevant, a.relevant
+		FROM tag t JOIN users u ON u.user_id = t.tagger
+		LEFT JOIN assessment a ON a.topic_id = t.topic_id AND a.doc_id = t.doc_id AND a.assessor = t.tagger
+		WHERE t.deleted_at IS NULL
+		ORDER BY t.topic_id, t.doc_id, t.start_char, t.tag_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	passages := make([]passage, 0)
+	for rows.Next() {
+		var p passage
+		var tagRel, docRel sql.NullString
+		err = rows.Scan(&p.TagId, &p.TopicId, &p.DocId, &p.Start, &p.End, &p.Text,
+			&p.TaggerId, &p.Tagger, &p.Category, &p.Note, &tagRel, &docRel)
+		if err != nil {
+			return nil, err
+		}
+		p.TagRelevance, p.DocRelevance = tagRel.String, docRel.String
+		passages = append(passages, p)
+	}
+	return passages, rows.Err()
+}
+
+func writePassages(w io.Writer, format string, passages []passage) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, p := range passages {
+		var err error
+		switch format {
+			case passageFormatJSONL, "":
+				err = enc.Encode(p)
+			case passageFormatTrec:
+				// Ungraded passages can't be written as judgments.
+				if p.Grade < 0 {
+					continue
+				}
+				_, err = fmt.Fprintf(bw, "%d %d %d %d %d %d\n", p.TopicId, p.TaggerId,
+					p.DocId, p.Start, p.End - p.Start, p.Grade)
+			default:
+				return fmt.Errorf("Unknown passage format %q", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Passage export handlers -------------------------------------------------------
+
+// GET /export/passages?format=jsonl|trec&topics=1,2&assessor=name&categories=holding,facts
+func exportPassagesHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = passageFormatJSONL
+	}
+	if format != passageFormatJSONL && format != passageFormatTrec {
+		return 400, fmt.Errorf("Unknown passage format %q", format)
+	}
+	opts := passageOptions{
+		Topics: parseFilter(r.FormValue("topics")),
+		Categories: parseFilter(r.FormValue("categories")),
+	}
+	if name := r.FormValue("assessor"); name != "" {
+		id, err := dbGetUserIdByName(i.db, strings.ToLower(name))
+		if err != nil {
+			return 400, err
+		}
+		opts.Assessor = id
+	}
+
+	p, err := i.passages(opts)
+	if err != nil {
+		return 500, err
+	}
+	if format == passageFormatJSONL {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=passages.jsonl")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=passage-qrels.txt")
+	}
+	err = writePassages(w, format, p)
+	if err != nil {
+		return 500, err
+	}
+	return 200, nil
+}
+
+func exportPassagesCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("export-passages", flag.ExitOnError)
+	format := fs.String("format", passageFormatJSONL, "jsonl or trec")
+	topics := fs.String("topics", "", "Comma separated topic ids [if empty then all]")
+	categories := fs.String("categories", "", "Comma separated tag categories [if empty then all]")
+	assessor := fs.String("assessor", "", "Only export this assessor's tags")
+	out := fs.String("o", "", "Output file [if empty then stdout]")
+	fs.Parse(args)
+
+	opts := passageOptions{
+		Topics: parseFilter(*topics),
+		Categories: parseFilter(*categories),
+	}
+	if *assessor != "" {
+		id, err := dbGetUserIdByName(i.db, strings.ToLower(*assessor))
+		if err != nil {
+			return err
+		}
+		opts.Assessor = id
+	}
+	p, err := i.passages(opts)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return writePassages(os.Stdout, *format, p)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = writePassages(f, *format, p)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* Pools are described in the database as follows:
+
+CREATE TABLE pool_source (
+
+	source_id SERIAL,
+
+	topic_id bigint NOT NULL,
+
+	-- 0 for the topic's own queries, shared by every assessor.
+	user_id int NOT NULL DEFAULT 0,
+
+	-- The assessor's search, if the source is one.
+	query_id int,
+
+	-- The imported run, if the source is one, see runs.go.
+	run VARCHAR(255),
+
+	query text NOT NULL,
+
+	total_hits int NOT NULL,
+
+	added_at TIMESTAMP,
+
+	PRIMARY KEY (source_id),
+
+	-- A search is pooled once.
+	UNIQUE (query_id)
+
+);
+
+CREATE TABLE pool (
+
+	source_id int NOT NULL,
+
+	topic_id bigint NOT NULL,
+
+	doc_id bigint NOT NULL,
+
+	rank int NOT NULL,
+
+	score double precision NOT NULL,
+
+	added_at TIMESTAMP,
+
+	PRIMARY KEY (source_id, doc_id),
+
+	FOREIGN KEY (source_id) REFERENCES pool_source (source_id) ON DELETE CASCADE
+
+);*/
+
+// A topic's pool is the top pool_depth documents of each of its queries. The
+// topic's own queries (its text, citing sentences and paragraphs, and extract
+// queries) are run the first time the topic is loaded and shared by every
+// assessor, each assessor's searches add to their own pool as they are made.
+// Loading a topic reads the pool from the database rather than searching
+// again, rebuild-pools searches again when the index changes. Only users who
+// can search (admins and assessors) extend pools, others see what is pooled.
+type poolSource struct {
+
+	SourceId int64
+
+	TopicId int64
+
+	UserId int64
+
+	QueryId int64
+
+	// Imported run name, empty for queries.
+	Run string
+
+	Query string
+
+	TotalHits int
+
+	// Pooled documents in rank order.
+	Docs []string
+
+	Scores []float64
+
+}
+
+// Held while a topic's pool is extended, so it isn't built twice at once.
+// Topics are locked separately, searches pooled for one topic don't hold up
+// loading another.
+var poolLocks = struct {
+
+	sync.Mutex
+
+	topics map[int64]*sync.Mutex
+
+}{topics: map[int64]*sync.Mutex{}}
+
+func poolLock(topic int64) *sync.Mutex {
+	poolLocks.Lock()
+	defer poolLocks.Unlock()
+	l, ok := poolLocks.topics[topic]
+	if !ok {
+		l = &sync.Mutex{}
+		poolLocks.topics[topic] = l
+	}
+	return l
+}
+
+// The topic's own queries and their text.
+func (i *Instance) topicQueries(topicId string) ([]string, []map[string]interface{}) {
+	topic := i.getTopic(topicId)
+	queries := []map[string]interface{}{createTextQuery(topic.Topic, "html")}
+	texts := []string{topic.Topic}
+
+	for _, e := range topic.Extracts {
+		for _, q := range []string{e.CitingSentence, e.CitingParagraph}{ // will need to change this to fix for new topic struct...
+			queries = append(queries, createTextQuery(q, "html"))
+			texts = append(texts, q)
+		}
+
+		queries = append(queries, e.EsQuery...)
+		texts = append(texts, e.Query...)
+	}
+	return texts, queries
+}
+
+// Runs the queries concurrently, returning results in query order.
+func (i *Instance) searchPoolQueries(userId int64, topicId string, queries []map[string]interface{}) ([]*ApiSearchResponse, error) {
+	results := make([]*ApiSearchResponse, len(queries))
+	errs := make([]error, len(queries))
+
+	var wg sync.WaitGroup
+
+	for x := range queries {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			q := queries[x]
+			q["_source"] = i.poolSourceFields()
+			q["from"] = 0
+			q["size"] = i.config.Topics.PoolDepth
+			qry, err := json.Marshal(q)
+			if err != nil {
+				errs[x] = err
+				return
+			}
+
+			esRes, err := i.docs.Search(qry)
+			if err != nil {
+				errs[x] = err
+				return
+			}
+
+			results[x], errs[x] = i.searchToApiSearchResponse(userId, topicId, esRes)
+		}(x)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// A source for search results, keeping the top pool_depth documents.
+func (i *Instance) newPoolSource(userId, queryId int64, query string, res *ApiSearchResponse) poolSource {
+	s := poolSource{UserId: userId, QueryId: queryId, Query: query, TotalHits: res.TotalHits}
+	for j, h := range res.Results {
+		if j >= i.config.Topics.PoolDepth {
+			break
+		}
+		s.Docs = append(s.Docs, h.Id)
+		s.Scores = append(s.Scores, h.Score)
+	}
+	return s
+}
+
+// Runs whichever of the topic's queries and the user's searches have not
+// been pooled yet.
+func (i *Instance) extendPool(userId int64, topicId string) error {
+	topic, err := strconv.ParseInt(topicId, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	lock := poolLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	sources := []poolSource{}
+	pooled, err := dbTopicPooled(i.db, topic)
+	if err != nil {
+		return err
+	}
+	if !pooled {
+		log.Printf("building pool for topic %s.\n", topicId)
+		texts, queries := i.topicQueries(topicId)
+		results, err := i.searchPoolQueries(userId, topicId, queries)
+		if err != nil {
+			return err
+		}
+		for x := range results {
+			sources = append(sources, i.newPoolSource(0, 0, texts[x], results[x]))
+		}
+	}
+
+	saved, err := dbGetUnpooledQueries(i.db, topic, userId)
+	if err != nil {
+		return err
+	}
+	if len(saved) > 0 {
+		queries := make([]map[string]interface{}, len(saved))
+		for x, q := range saved {
+			queries[x], err = q.parse()
+			if err != nil {
+				return err
+			}
+		}
+		results, err := i.searchPoolQueries(userId, topicId, queries)
+		if err != nil {
+			return err
+		}
+		for x := range results {
+			sources = append(sources, i.newPoolSource(userId, saved[x].QueryId, saved[x].Query, results[x]))
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil
+	}
+	return dbSavePoolSources(i.db, topic, sources, time.Now())
+}
+
+// The user's pool for the topic, ordered by the pooling strategy, extended
+// first if extend is set and the user can search.
+func (i *Instance) topicPool(userId int64, topicId string, extend bool) ([]queryRes, []ApiCaseResponse, error) {
+	if extend {
+		role, err := dbGetUserRole(i.db, userId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hasRole(role, writeRoles) {
+			err = i.extendPool(userId, topicId)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	topic, _ := strconv.ParseInt(topicId, 10, 64)
+	sources, err := dbGetPoolSources(i.db, topic, userId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	runs := make([]poolRun, len(sources))
+	stats := make([]queryRes, len(sources))
+	scores := map[string]float64{}
+	for x, s := range sources {
+		runs[x] = poolRun{Name: s.Query, Docs: s.Docs, Scores: s.Scores}
+		stats[x] = queryRes{Text: s.Query, Results: s.TotalHits}
+		if s.Run != "" {
+			stats[x].Text = "run: " + s.Run
+		}
+		for j, id := range s.Docs {
+			if _, ok := scores[id]; !ok {
+				scores[id] = s.Scores[j]
+			}
+		}
+	}
+
+	opts := i.poolOptions()
+	if opts.Strategy == poolMoveToFront {
+		judged, err := i.judgedRelevant(userId, topicId)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts.Judged = judged
+	}
+	pooled, err := pool(runs, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cases := []ApiCaseResponse{}
+	if len(pooled) == 0 {
+		return stats, cases, nil
+	}
+	ids := make([]string, len(pooled))
+	for j, p := range pooled {
+		ids[j] = p.Id
+	}
+	res, err := i.elasticIdsQuery(userId, topicId, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	byId := map[string]ApiCaseResponse{}
+	for _, h := range res.Results {
+		byId[h.Id] = h
+	}
+	// Documents no longer in the index are left out until the pool is rebuilt.
+	for _, p := range pooled {
+		h, ok := byId[p.Id]
+		if !ok {
+			continue
+		}
+		h.Score = scores[p.Id]
+		cases = append(cases, h)
+		stats[p.Run].PooledResults++
+	}
+	return stats, cases, nil
+}
+
+// Adds an assessor's search to their pool for the topic, unless extendPool
+// already pooled it.
+func (i *Instance) poolSearch(userId, queryId int64, topicId string, query string, res *ApiSearchResponse) error {
+	if i.byList {
+		return nil
+	}
+	topic, err := strconv.ParseInt(topicId, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	lock := poolLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+	return dbSavePoolSources(i.db, topic, []poolSource{i.newPoolSource(userId, queryId, query, res)}, time.Now())
+}
+
+// Searches every query of the topics again, all topics if topics is empty.
+// Imported runs are kept.
+func (i *Instance) rebuildPools(topics map[string]bool) ([]string, error) {
+	ids := []string{}
+	for id := range i.topics {
+		if len(topics) == 0 || topics[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		topic, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		err = i.rebuildPool(topic, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// Runs the topic's queries and every user's searches on it, then replaces
+// the pooled ones in one transaction, so the pool is never seen part built
+// and is left as it was if a search fails.
+func (i *Instance) rebuildPool(topic int64, topicId string) error {
+	lock := poolLock(topic)
+	lock.Lock()
+	defer lock.Unlock()
+
+	texts, queries := i.topicQueries(topicId)
+	saved, err := dbGetTopicQueries(i.db, topic)
+	if err != nil {
+		return err
+	}
+	for _, q := range saved {
+		lq, err := q.parse()
+		if err != nil {
+			return err
+		}
+		queries = append(queries, lq)
+	}
+	results, err := i.searchPoolQueries(0, topicId, queries)
+	if err != nil {
+		return err
+	}
+
+	sources := []poolSource{}
+	for x := range texts {
+		sources = append(sources, i.newPoolSource(0, 0, texts[x], results[x]))
+	}
+	for x, q := range saved {
+		sources = append(sources, i.newPoolSource(q.UserId, q.QueryId, q.Query, results[len(texts) + x]))
+	}
+	return dbReplacePoolQueries(i.db, topic, sources, time.Now())
+}
+
+func dbTopicPooled(db *sql.DB, topic int64) (bool, error) {
+	var pooled bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pool_source WHERE topic_id = $1 AND user_id = 0 AND run IS NULL)",
+		topic).Scan(&pooled)
+	return pooled, err
+}
+
+// The user's searches on the topic that aren't pooled, oldest first.
+func dbGetUnpooledQueries(db *sql.DB, topic, user int64) ([]savedQuery, error) {
+	rows, err := db.Query(`SELECT q.query_id, q.user_id, q.query, q.fields FROM query q
+		WHERE q.topic_id = $1 AND q.user_id = $2
+		AND NOT EXISTS (SELECT 1 FROM pool_source s WHERE s.query_id = q.query_id)
+		ORDER BY q.query_id`, topic, user)
+	if err != nil {
+		return nil, err
+	}
+	return scanSavedQueries(rows)
+}
+
+func scanSavedQueries(rows *sql.Rows) ([]savedQuery, error) {
+	defer rows.Close()
+	queries := make([]savedQuery, 0)
+	for rows.Next() {
+		var q savedQuery
+		var fields sql.NullString
+		err := rows.Scan(&q.QueryId, &q.UserId, &q.Query, &fields)
+		if err != nil {
+			return nil, err
+		}
+		q.Fields, err = scanQueryFields(fields)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+// Every user's searches on the topic, oldest first.
+func dbGetTopicQueries(db *sql.DB, topic int64) ([]savedQuery, error) {
+	rows, err := db.Query(`SELECT query_id, user_id, query, fields FROM query
+		WHERE topic_id = $1 ORDER BY query_id`, topic)
+	if err != nil {
+		return nil, err
+	}
+	return scanSavedQueries(rows)
+}
+
+func dbSavePoolSources(db *sql.DB, topic int64, sources []poolSource, date time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		_, err = dbSavePoolSource(tx, topic, s, date)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the documents pooled, none if the search is already pooled.
+// Document ids must be numeric, see importRun.
+func dbSavePoolSource(tx *sql.Tx, topic int64, s poolSource, date time.Time) (int, error) {
+	var sourceId int64
+	err := tx.QueryRow(`INSERT INTO pool_source (topic_id, user_id, query_id, run, query, total_hits, added_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (query_id) DO NOTHING RETURNING source_id`,
+		topic, s.UserId, sql.NullInt64{Int64: s.QueryId, Valid: s.QueryId != 0},
+		sql.NullString{String: s.Run, Valid: s.Run != ""}, s.Query, s.TotalHits, date).Scan(&sourceId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	docs := 0
+	for j, id := range s.Docs {
+		doc, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Document id %q is not numeric", id)
+		}
+		res, err := tx.Exec(`INSERT INTO pool (source_id, topic_id, doc_id, rank, score, added_at)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+			sourceId, topic, doc, j + 1, s.Scores[j], date)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			docs++
+		}
+	}
+	return docs, nil
+}
+
+// The topic's queries, imported runs, then the user's searches, each in the
+// order added, with their documents.
+func dbGetPoolSources(db *sql.DB, topic, user int64) ([]poolSource, error) {
+	rows, err := db.Query(`SELECT s.source_id, s.user_id, COALESCE(s.query_id, 0), COALESCE(s.run, ''), s.query, s.total_hits, p.doc_id, p.score
+		FROM pool_source s LEFT JOIN pool p ON p.source_id = s.source_id
+		WHERE s.topic_id = $1 AND (s.user_id = 0 OR s.user_id = $2)
+		ORDER BY s.user_id <> 0, s.run IS NOT NULL, s.source_id, p.rank`, topic, user)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	sources := make([]poolSource, 0)
+	for rows.Next() {
+		var s poolSource
+		var doc sql.NullInt64
+		var score sql.NullFloat64
+		err = rows.Scan(&s.SourceId, &s.UserId, &s.QueryId, &s.Run, &s.Query, &s.TotalHits, &doc, &score)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(sources); n == 0 || sources[n - 1].SourceId != s.SourceId {
+			sources = append(sources, s)
+		}
+		if doc.Valid {
+			last := &sources[len(sources) - 1]
+			last.Docs = append(last.Docs, strconv.FormatInt(doc.Int64, 10))
+			last.Scores = append(last.Scores, score.Float64)
+		}
+	}
+	return sources, rows.Err()
+}
+
+// Replaces the topic's query sources, keeping imported runs.
+func dbReplacePoolQueries(db *sql.DB, topic int64, sources []poolSource, date time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM pool_source WHERE topic_id = $1 AND run IS NULL", topic)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, s := range sources {
+		_, err = dbSavePoolSource(tx, topic, s, date)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Pool rebuild handlers ---------------------------------------------------------
+
+// POST /admin/pools/rebuild?topics=1,2
+func apiRebuildPools(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	if i.byList {
+		return 400, fmt.Errorf("Pools are read from the document list")
+	}
+
+	log.Printf("user %d - rebuilding pools.\n", auth)
+	topics, err := i.rebuildPools(parseFilter(r.FormValue("topics")))
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(topics)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func rebuildPoolsCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("rebuild-pools", flag.ExitOnError)
+	topics := fs.String("topics", "", "Comma separated topic ids [if empty then all]")
+	fs.Parse(args)
+
+	ids, err := i.rebuildPools(parseFilter(*topics))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Pooling strategies, set with topics.pooling in config.json. Every strategy
+// pools the top pool_depth documents of each query (run), they differ in the
+// order documents are presented in, which matters when topics.pool_size cuts
+// the pool short or assessors stop early.
+const (
+	// Each run in turn, in rank order, as pooled documents were always listed.
+	poolDepth string = "depth"
+
+	// Rank 1 of every run, then rank 2 and so on.
+	poolRoundRobin string = "round-robin"
+
+	// Reciprocal rank fusion, sum of 1 / (k + rank).
+	poolRRF string = "rrf"
+
+	// Sum of min-max normalised scores.
+	poolCombSUM string = "combsum"
+
+	// CombSUM times the number of runs retrieving the document.
+	poolCombMNZ string = "combmnz"
+
+	// Move-to-front (Cormack et al. 1998), runs are taken from while they find
+	// relevant documents and moved back when they give a non-relevant one.
+	poolMoveToFront string = "move-to-front"
+)
+
+const defaultRRFK = 60.0
+
+// A ranked list of documents from one query, best first.
+type poolRun struct {
+
+	Name string
+
+	Docs []string
+
+	Scores []float64
+
+}
+
+type poolOptions struct {
+
+	Strategy string
+
+	// Documents taken from each run.
+	Depth int
+
+	// Largest pool, 0 for no limit.
+	Size int
+
+	RRFK float64
+
+	// Judged documents and whether they were judged relevant, for
+	// move-to-front.
+	Judged map[string]bool
+
+}
+
+func (i *Instance) poolOptions() poolOptions {
+	return poolOptions{
+		Strategy: i.config.Topics.Pooling,
+		Depth: i.config.Topics.PoolDepth,
+		Size: i.config.Topics.PoolSize,
+		RRFK: i.config.Topics.RRFK,
+	}
+}
+
+// A pooled document and the run it is credited to, the first run (in run
+// order) that retrieved it.
+type pooledDoc struct {
+
+	Id string
+
+	Run int
+
+}
+
+// Pools the runs, the order is the same for the same runs and judgments.
+func pool(runs []poolRun, opts poolOptions) ([]pooledDoc, error) {
+	if opts.Depth > 0 {
+		cut := make([]poolRun, len(runs))
+		for r := range runs {
+			cut[r] = runs[r]
+			if len(cut[r].Docs) > opts.Depth {
+				cut[r].Docs = cut[r].Docs[:opts.Depth]
+				if len(cut[r].Scores) > opts.Depth {
+					cut[r].Scores = cut[r].Scores[:opts.Depth]
+				}
+			}
+		}
+		runs = cut
+	}
+
+	credit := map[string]int{}
+	for r := range runs {
+		for _, id := range runs[r].Docs {
+			if _, ok := credit[id]; !ok {
+				credit[id] = r
+			}
+		}
+	}
+
+	var order []string
+	switch opts.Strategy {
+		case poolDepth, "":
+			order = depthOrder(runs)
+		case poolRoundRobin:
+			order = roundRobinOrder(runs)
+		case poolRRF:
+			k := opts.RRFK
+			if k <= 0 {
+				k = defaultRRFK
+			}
+			order = fusedOrder(runs, func(run poolRun, rank int) float64 {
+				return 1 / (k + float64(rank + 1))
+			}, false)
+		case poolCombSUM, poolCombMNZ:
+			order = fusedOrder(runs, normalisedScore, opts.Strategy == poolCombMNZ)
+		case poolMoveToFront:
+			order = moveToFrontOrder(runs, opts.Judged)
+		default:
+			return nil, fmt.Errorf("Unknown pooling strategy %q", opts.Strategy)
+	}
+
+	if opts.Size > 0 && len(order) > opts.Size {
+		order = order[:opts.Size]
+	}
+	docs := make([]pooledDoc, len(order))
+	for j, id := range order {
+		docs[j] = pooledDoc{id, credit[id]}
+	}
+	return docs, nil
+}
+
+func depthOrder(runs []poolRun) []string {
+	seen := map[string]bool{}
+	order := []string{}
+	for _, run := range runs {
+		for _, id := range run.Docs {
+			if !seen[id] {
+				seen[id] = true
+				order = append(order, id)
+			}
+		}
+	}
+	return order
+}
+
+func roundRobinOrder(runs []poolRun) []string {
+	seen := map[string]bool{}
+	order := []string{}
+	for rank := 0; ; rank++ {
+		more := false
+		for _, run := range runs {
+			if rank >= len(run.Docs) {
+				continue
+			}
+			more = true
+			if id := run.Docs[rank]; !seen[id] {
+				seen[id] = true
+				order = append(order, id)
+			}
+		}
+		if !more {
+			return order
+		}
+	}
+}
+
+// Min-max normalised score, runs without scores score by rank.
+func normalisedScore(run poolRun, rank int) float64 {
+	if len(run.Scores) != len(run.Docs) {
+		return 1 - float64(rank) / float64(len(run.Docs))
+	}
+	lo, hi := run.Scores[0], run.Scores[0]
+	for _, s := range run.Scores {
+		if s < lo {
+			lo = s
+		}
+		if s > hi {
+			hi = s
+		}
+	}
+	if hi == lo {
+		return 1
+	}
+	return (run.Scores[rank] - lo) / (hi - lo)
+}
+
+// Documents by their summed score over runs, ties by id.
+func fusedOrder(runs []poolRun, score func(poolRun, int) float64, mnz bool) []string {
+	sums := map[string]float64{}
+	hits := map[string]int{}
+	order := []string{}
+	for _, run := range runs {
+		for rank, id := range run.Docs {
+			if _, ok := sums[id]; !ok {
+				order = append(order, id)
+			}
+			sums[id] += score(run, rank)
+			hits[id]++
+		}
+	}
+	if mnz {
+		for id := range sums {
+			sums[id] *= float64(hits[id])
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if sums[order[a]] != sums[order[b]] {
+			return sums[order[a]] > sums[order[b]]
+		}
+		return order[a] < order[b]
+	})
+	return order
+}
+
+// Takes documents from the run with the highest priority, all runs starting
+// equal (ties go to the earlier run). A judged non-relevant document lowers
+// the run's priority, so the next document comes from the best run left.
+// Unjudged documents don't change it, they are the ones to judge next.
+func moveToFrontOrder(runs []poolRun, judged map[string]bool) []string {
+	priority := make([]int, len(runs))
+	next := make([]int, len(runs))
+	seen := map[string]bool{}
+	order := []string{}
+	for {
+		best := -1
+		for r := range runs {
+			if next[r] < len(runs[r].Docs) && (best < 0 || priority[r] > priority[best]) {
+				best = r
+			}
+		}
+		if best < 0 {
+			return order
+		}
+		id := runs[best].Docs[next[best]]
+		next[best]++
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		order = append(order, id)
+		if relevant, ok := judged[id]; ok && !relevant {
+			priority[best]--
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Normalised, A scores b 1, a .5, c 0 and B d 1, a .3, f 0, so a sums .8 from
+// two runs against 1 for b, d and e from one.
+var testRuns = []poolRun{
+	{Name: "A", Docs: []string{"b", "a", "c"}, Scores: []float64{4, 2, 0}},
+	{Name: "B", Docs: []string{"d", "a", "f"}, Scores: []float64{10, 3, 0}},
+	{Name: "C", Docs: []string{"e"}, Scores: []float64{7}},
+}
+
+func pooledIds(docs []pooledDoc) []string {
+	ids := []string{}
+	for _, d := range docs {
+		ids = append(ids, d.Id)
+	}
+	return ids
+}
+
+func TestPool(t *testing.T) {
+	tests := []struct {
+
+		name string
+
+		opts poolOptions
+
+		want []string
+
+	}{
+		{"depth", poolOptions{Strategy: poolDepth}, []string{"b", "a", "c", "d", "f", "e"}},
+		{"default", poolOptions{}, []string{"b", "a", "c", "d", "f", "e"}},
+		{"round-robin", poolOptions{Strategy: poolRoundRobin}, []string{"b", "d", "e", "a", "c", "f"}},
+		// a 2/62, b, d and e 1/61 tied by id, c and f 1/63.
+		{"rrf", poolOptions{Strategy: poolRRF}, []string{"a", "b", "d", "e", "c", "f"}},
+		// a 1/3 + 1/3, b, d and e 1/2.
+		{"rrf k", poolOptions{Strategy: poolRRF, RRFK: 1}, []string{"a", "b", "d", "e", "c", "f"}},
+		// b, d and e 1 tied by id, a .8, c and f 0.
+		{"combsum", poolOptions{Strategy: poolCombSUM}, []string{"b", "d", "e", "a", "c", "f"}},
+		// a 1.6, then as CombSUM.
+		{"combmnz", poolOptions{Strategy: poolCombMNZ}, []string{"a", "b", "d", "e", "c", "f"}},
+		// b judged non-relevant sends A behind B, which runs out before C.
+		{"move-to-front", poolOptions{Strategy: poolMoveToFront, Judged: map[string]bool{"b": false, "d": true}}, []string{"b", "d", "a", "f", "e", "c"}},
+		{"move-to-front unjudged", poolOptions{Strategy: poolMoveToFront}, []string{"b", "a", "c", "d", "f", "e"}},
+		{"depth cut", poolOptions{Strategy: poolDepth, Depth: 2}, []string{"b", "a", "d", "e"}},
+		{"size cut", poolOptions{Strategy: poolRoundRobin, Size: 4}, []string{"b", "d", "e", "a"}},
+		// With depth 1 every run scores only its top document, normalised to 1.
+		{"combsum depth", poolOptions{Strategy: poolCombSUM, Depth: 1}, []string{"b", "d", "e"}},
+	}
+	for _, test := range tests {
+		docs, err := pool(testRuns, test.opts)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := pooledIds(docs); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	_, err := pool(testRuns, poolOptions{Strategy: "borda"})
+	if err == nil {
+		t.Errorf("expected an error for an unknown strategy")
+	}
+}
+
+func TestPoolCredit(t *testing.T) {
+	// Credited to the first run retrieving it whatever the order.
+	docs, err := pool(testRuns, poolOptions{Strategy: poolCombMNZ})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pooledDoc{{"a", 0}, {"b", 0}, {"d", 1}, {"e", 2}, {"c", 0}, {"f", 1}}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %v, want %v", docs, want)
+	}
+}
+
+func TestNormalisedScore(t *testing.T) {
+	tests := []struct {
+
+		run poolRun
+
+		want []float64
+
+	}{
+		{testRuns[0], []float64{1, 0.5, 0}},
+		{poolRun{Docs: []string{"a", "b"}, Scores: []float64{2, 2}}, []float64{1, 1}},
+		// Without scores, by rank.
+		{poolRun{Docs: []string{"a", "b", "c", "d"}}, []float64{1, 0.75, 0.5, 0.25}},
+	}
+	for _, test := range tests {
+		got := []float64{}
+		for rank := range test.run.Docs {
+			got = append(got, normalisedScore(test.run, rank))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.run, got, test.want)
+		}
+	}
+}
+
+func TestFusedOrderTies(t *testing.T) {
+	// Equal sums are ordered by id, not by run or rank.
+	runs := []poolRun{
+		{Docs: []string{"z", "y"}, Scores: []float64{1, 0}},
+		{Docs: []string{"x", "y"}, Scores: []float64{1, 0}},
+	}
+	got := fusedOrder(runs, normalisedScore, false)
+	if want := []string{"x", "z", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
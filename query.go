@@ -11,7 +11,6 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	lexes "github.com/danlocke/lexes/parser"
@@ -54,8 +53,17 @@ func apiSearch(i *Instance, w http.ResponseWriter, r *http.Request) (int, error)
 		return 500, err
 	}
 
+	topicId := strconv.FormatInt(req.TopicId, 10)
+	ok, err := i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
 	// add query to database ...
-	_, err = dbSaveQuery(i.db, req.Query, req.TopicId, auth, time.Now())
+	queryId, err := dbSaveQuery(i.db, req.Query, req.Fields, req.TopicId, auth, time.Now())
 	if err != nil {
 		return 500, err
 	}
@@ -66,11 +74,10 @@ func apiSearch(i *Instance, w http.ResponseWriter, r *http.Request) (int, error)
 	}
 
 	log.Println("Query - ", req.Query)
-	q, err := lexes.Parse(req.Query, "html", req.Fields, true, false)
+	qry, err := savedQuery{Query: req.Query, Fields: req.Fields}.parse()
 	if err != nil {
 		return 500, err
 	}
-	qry := *q
 	qry["from"] = 0
 	qry["size"] = i.config.Topics.PoolDepth * 2 
 
@@ -80,10 +87,17 @@ func apiSearch(i *Instance, w http.ResponseWriter, r *http.Request) (int, error)
 	}
 
 	log.Printf("user %d - search - %s.\n", auth, req.Query)
-	res, err := i.elasticSearchResponse(auth, strconv.FormatInt(req.TopicId, 10), buff)
+	res, err := i.elasticSearchResponse(auth, topicId, buff)
 	if err != nil {
 		return 500, err
 	}
+
+	if _, ok := i.topics[topicId]; ok {
+		err = i.poolSearch(auth, queryId, topicId, req.Query, res)
+		if err != nil {
+			return 500, err
+		}
+	}
 	
 	hits := []ApiCaseResponse{}
 	count := 0
@@ -125,9 +139,51 @@ func apiSearch(i *Instance, w http.ResponseWriter, r *http.Request) (int, error)
 	return 200, nil
 }
 
-func dbSaveQuery(db *sql.DB, query string, topic, user int64, date time.Time) (sql.Result, error) {
-	return db.Exec("INSERT INTO query (topic_id, query, user_id, date_added) VALUES ($1, $2, $3, $4)",
-		topic, query, user, date)
+// A search as saved, with the fields it was parsed with so it is searched
+// the same way when pooled.
+type savedQuery struct {
+
+	QueryId int64
+
+	UserId int64
+
+	Query string
+
+	Fields []string
+
+}
+
+func (q savedQuery) parse() (map[string]interface{}, error) {
+	lq, err := lexes.Parse(q.Query, "html", q.Fields, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return *lq, nil
+}
+
+// Fields are kept as json, NULL if none were given.
+func dbSaveQuery(db *sql.DB, query string, fields []string, topic, user int64, date time.Time) (int64, error) {
+	var f sql.NullString
+	if fields != nil {
+		buff, err := json.Marshal(fields)
+		if err != nil {
+			return 0, err
+		}
+		f = sql.NullString{String: string(buff), Valid: true}
+	}
+	var id int64
+	err := db.QueryRow("INSERT INTO query (topic_id, query, fields, user_id, date_added) VALUES ($1, $2, $3, $4, $5) RETURNING query_id",
+		topic, query, f, user, date).Scan(&id)
+	return id, err
+}
+
+func scanQueryFields(f sql.NullString) ([]string, error) {
+	if !f.Valid {
+		return nil, nil
+	}
+	var fields []string
+	err := json.Unmarshal([]byte(f.String), &fields)
+	return fields, err
 }
 
 func dbGetUserQueries(db *sql.DB, topic string, user int64) ([]string, error) {
@@ -151,11 +207,11 @@ func dbGetUserQueries(db *sql.DB, topic string, user int64) ([]string, error) {
 }
 
 func (i *Instance) elasticSearchResponse(userId int64, topicId string, query []byte) (*ApiSearchResponse, error) {
-	esRes, err := i.es.Search(i.searchIndex, query, "")
+	esRes, err := i.docs.Search(query)
 	if err != nil {
 		return nil, err
 	}
-	api, err := i.elasticSearchToApiSearchResponse(userId, topicId, esRes)
+	api, err := i.searchToApiSearchResponse(userId, topicId, esRes)
 	return api, err
 }
 
@@ -181,83 +237,23 @@ func (i *Instance) elasticSearchResponse(userId int64, topicId string, query []b
 // 	return res, nil
 // }
 
-// Really just exclude duplicates over the set of queries...
-// Returns total hits, pooled hits for each, result list, errors... 
-func (i *Instance) elasticTopicQueryHits(userId int64, topicId string, queryStrings []string, queries []map[string]interface{}) ([]queryRes, []ApiCaseResponse, error) {
-	retQueue :=  make(chan queryRes, len(queries))
-	hitsQueue := make(chan ApiCaseResponse, i.config.Topics.PoolDepth * len(queries))
-
-	seenId := new(sync.Map)
-	errorChan := make(chan error, len(queries) * 3)
-
-	var wg sync.WaitGroup
-
-	for x := range queries {
-		wg.Add(1)
-		go func(x int) {
-			defer wg.Done()
-			q := queries[x]
-			q["_source"] = []string{"id", "name"}
-			q["from"] = 0
-			q["size"] = i.config.Topics.PoolDepth
-			qry, err := json.Marshal(q)
-			if err != nil {
-				errorChan <- err 	
-			}
-
-			esRes, err := i.es.Search(i.searchIndex, qry, "")
-			if err != nil {
-				errorChan <- err 	
-			}
-
-			api, err := i.elasticSearchToApiSearchResponse(userId, topicId, esRes)
-			if err != nil {
-				errorChan <- err 	
-			}
-
-			count := 0 
-			for j := range api.Results {
-				if _, ok := seenId.LoadOrStore(api.Results[j].Id, 0); !ok {
-					hitsQueue <- api.Results[j]
-					count++
-				}
-			}
-
-			retQueue <- queryRes{
-				Text: queryStrings[x],
-				PooledResults: count, 
-				Results: api.TotalHits,
-			}
-
-		}(x)
-		
-	}
-
-	wg.Wait()
-
-	close(errorChan)
-	close(retQueue)
-	close(hitsQueue)
-
-	if len(errorChan) >= 1 {
-		return nil, nil, <-errorChan
-	}
-
-	stats := []queryRes{}
-	cases := []ApiCaseResponse{}
-
-	for t := range retQueue {
-		stats = append(stats, t)
+// The user's judgments for the topic, relevant being above the lowest grade.
+func (i *Instance) judgedRelevant(userId int64, topicId string) (map[string]bool, error) {
+	assessed, err := dbGetAssessedPerTopic(i.db, userId, topicId)
+	if err != nil {
+		return nil, err
 	}
-
-	for t := range hitsQueue {
-		cases = append(cases, t)
+	labels, _ := i.gradeLabels()
+	grades := i.grades()
+	judged := map[string]bool{}
+	for id, rel := range assessed {
+		if g, ok := grades[rel]; ok {
+			judged[id] = g > grades[labels[0]]
+		}
 	}
-
-	return stats, cases, nil
+	return judged, nil
 }
 
-
 func (i *Instance) elasticTopicDocListQuery(userId int64, topicId string) ([]queryRes, []ApiCaseResponse, error) {
 	ids := i.docList[topicId]
 	exclude := i.excludeList[topicId]
@@ -283,12 +279,12 @@ func (i *Instance) elasticTopicDocListQuery(userId int64, topicId string) ([]que
 
 	fmt.Printf("Query: %s\n", qry)
 
-	esRes, err := i.es.Search(i.searchIndex, qry, "")
+	esRes, err := i.docs.Search(qry)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	api, err := i.elasticSearchToApiSearchResponse(userId, topicId, esRes)
+	api, err := i.searchToApiSearchResponse(userId, topicId, esRes)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -300,6 +296,32 @@ func (i *Instance) elasticTopicDocListQuery(userId int64, topicId string) ([]que
 	}}, api.Results, nil
 }
 
+// Fields fetched for documents listed in a pool, the text is only loaded
+// when a document is opened.
+func (i *Instance) poolSourceFields() []string {
+	f := i.config.Elastic.Fields.withDefaults()
+	return []string{f.Id, f.Name, f.DateFiled, f.Court, f.Citation}
+}
+
+// Fetches the given documents, in no particular order.
+func (i *Instance) elasticIdsQuery(userId int64, topicId string, ids []string) (*ApiSearchResponse, error) {
+	query := map[string]interface{}{
+		"_source": i.poolSourceFields(),
+		"from": 0,
+		"size": len(ids),
+		"query": map[string]interface{}{
+			"ids": map[string]interface{}{
+				"values": ids,
+			},
+		},
+	}
+
+	qry, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	return i.elasticSearchResponse(userId, topicId, qry)
+}
 
 // -----------------------------------------------------------------------------
 // For creating standard match queries from pieces of text
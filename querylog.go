@@ -0,0 +1,437 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lexes "github.com/danlocke/lexes/parser"
+)
+
+// Query log analytics read the query table, each search's pool source (its
+// result count and pooled documents) and the searching assessor's judgments.
+// A search's new documents are those it added to the assessor's pool that no
+// topic query or imported run, nor any earlier search of theirs, had. Topic
+// queries and runs are taken as pooled before every search, their sources are
+// saved again whenever pools are rebuilt or runs imported again. Operators are
+// read from the query lexes parses each search into, except proximity: lexes
+// gives w/s and w/p as span_near with slops of 20 and 50, the same as w/20 and
+// w/50, so w/n, w/s and w/p are read from the search text outside quoted
+// phrases.
+const (
+	opProximity string = "w/n"
+	opSentence string = "w/s"
+	opParagraph string = "w/p"
+	opWildcard string = "wildcard"
+	opPhrase string = "phrase"
+	opAnd string = "and"
+	opOr string = "or"
+	opNot string = "not"
+
+	// Queries lexes could not parse.
+	opInvalid string = "invalid"
+)
+
+type QueryLogEntry struct {
+
+	QueryId int64 `json:"query_id"`
+
+	TopicId string `json:"topic"`
+
+	User string `json:"user"`
+
+	Date time.Time `json:"date"`
+
+	Query string `json:"query"`
+
+	// Total hits, null for searches made before pools were kept.
+	Results *int `json:"results"`
+
+	NewPooled int `json:"new_pooled"`
+
+	// New documents the assessor judged relevant.
+	NewRelevant int `json:"new_relevant"`
+
+	Operators []string `json:"operators"`
+
+}
+
+// Searches grouped by topic, user or day.
+type QueryGroup struct {
+
+	Key string `json:"key"`
+
+	Queries int `json:"queries"`
+
+	// Distinct topics or users searching.
+	Topics int `json:"topics"`
+
+	Users int `json:"users"`
+
+	MeanResults stat `json:"mean_results"`
+
+	NewPooled int `json:"new_pooled"`
+
+	NewRelevant int `json:"new_relevant"`
+
+}
+
+type QueryLogReport struct {
+
+	Queries []QueryLogEntry `json:"queries"`
+
+	Topics []QueryGroup `json:"topics"`
+
+	Users []QueryGroup `json:"users"`
+
+	// Keyed by date, yyyy-mm-dd, for all searches and for each topic and user.
+	Days []QueryGroup `json:"days"`
+
+	TopicDays map[string][]QueryGroup `json:"topic_days"`
+
+	UserDays map[string][]QueryGroup `json:"user_days"`
+
+	// Searches using each operator.
+	Operators map[string]int `json:"operators"`
+
+}
+
+// Operators used in a parsed query.
+func queryOperators(q interface{}, ops map[string]bool) {
+	switch v := q.(type) {
+		case map[string]interface{}:
+			for k, c := range v {
+				switch k {
+					case "span_near":
+						ops[opProximity] = true
+					case "wildcard", "prefix", "span_multi":
+						ops[opWildcard] = true
+					case "match_phrase":
+						ops[opPhrase] = true
+					case "must":
+						if n, ok := c.([]interface{}); !ok || len(n) > 1 {
+							ops[opAnd] = true
+						}
+					case "should":
+						if n, ok := c.([]interface{}); !ok || len(n) > 1 {
+							ops[opOr] = true
+						}
+					case "must_not":
+						ops[opNot] = true
+				}
+				queryOperators(c, ops)
+			}
+		case []interface{}:
+			for _, c := range v {
+				queryOperators(c, ops)
+			}
+	}
+}
+
+var proximityRe = regexp.MustCompile(`(?i)(?:^|[\s()])w/(s|p|\d+)\b`)
+var phraseRe = regexp.MustCompile(`"[^"]*"`)
+
+// Proximity operators written in the search text, false if there are none.
+func proximityOperators(query string, ops map[string]bool) bool {
+	found := false
+	for _, m := range proximityRe.FindAllStringSubmatch(phraseRe.ReplaceAllString(query, " "), -1) {
+		switch strings.ToLower(m[1]) {
+			case "s":
+				ops[opSentence] = true
+			case "p":
+				ops[opParagraph] = true
+			default:
+				ops[opProximity] = true
+		}
+		found = true
+	}
+	return found
+}
+
+func parseOperators(query string) []string {
+	lq, err := lexes.Parse(query, "html", nil, true, false)
+	if err != nil {
+		return []string{opInvalid}
+	}
+	// Through json so the walk sees plain maps and slices.
+	buff, err := json.Marshal(*lq)
+	if err != nil {
+		return []string{opInvalid}
+	}
+	var q interface{}
+	err = json.Unmarshal(buff, &q)
+	if err != nil {
+		return []string{opInvalid}
+	}
+	ops := map[string]bool{}
+	queryOperators(q, ops)
+	if ops[opProximity] {
+		delete(ops, opProximity)
+		// Parsed as proximity but written some other way.
+		if !proximityOperators(query, ops) {
+			ops[opProximity] = true
+		}
+	}
+	res := make([]string, 0, len(ops))
+	for op := range ops {
+		res = append(res, op)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// The searches on the topics by the user, all topics and users if empty.
+func (i *Instance) queryLogReport(topics map[string]bool, user string) (*QueryLogReport, error) {
+	log, err := dbGetQueryLog(i.db)
+	if err != nil {
+		return nil, err
+	}
+	sources, err := dbGetAllPoolSources(i.db)
+	if err != nil {
+		return nil, err
+	}
+	assessments, err := dbGetAssessments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	labels, _ := i.gradeLabels()
+	grades := i.grades()
+
+	type judgmentKey struct{ topic, doc, user int64 }
+	relevant := map[judgmentKey]bool{}
+	for _, a := range assessments {
+		relevant[judgmentKey{a.TopicId, a.DocId, a.UserId}] = grades[a.Relevance] > grades[labels[0]]
+	}
+
+	// Documents pooled by topic queries and runs, and by each search.
+	shared := map[int64]map[string]bool{}
+	searches := map[int64]poolSource{}
+	for _, s := range sources {
+		if s.QueryId != 0 {
+			searches[s.QueryId] = s
+			continue
+		}
+		if _, ok := shared[s.TopicId]; !ok {
+			shared[s.TopicId] = map[string]bool{}
+		}
+		for _, id := range s.Docs {
+			shared[s.TopicId][id] = true
+		}
+	}
+
+	// Documents each search added to its assessor's pool, searches in the
+	// order made.
+	type poolKey struct{ topic, user int64 }
+	seen := map[poolKey]map[string]bool{}
+	added := map[int64][]string{}
+	for _, q := range log {
+		s, ok := searches[q.QueryId]
+		if !ok {
+			continue
+		}
+		k := poolKey{s.TopicId, s.UserId}
+		if _, ok := seen[k]; !ok {
+			seen[k] = map[string]bool{}
+		}
+		for _, id := range s.Docs {
+			if !shared[s.TopicId][id] && !seen[k][id] {
+				seen[k][id] = true
+				added[s.QueryId] = append(added[s.QueryId], id)
+			}
+		}
+	}
+
+	report := &QueryLogReport{
+		Queries: []QueryLogEntry{},
+		Operators: map[string]int{},
+		TopicDays: map[string][]QueryGroup{},
+		UserDays: map[string][]QueryGroup{},
+	}
+	byTopic := map[string]*queryGroupCounts{}
+	byUser := map[string]*queryGroupCounts{}
+	byDay := map[string]*queryGroupCounts{}
+	topicDays := map[string]map[string]*queryGroupCounts{}
+	userDays := map[string]map[string]*queryGroupCounts{}
+	for _, q := range log {
+		if (len(topics) > 0 && !topics[q.TopicId]) || (user != "" && q.User != user) {
+			continue
+		}
+		q.Operators = parseOperators(q.Query)
+		for _, op := range q.Operators {
+			report.Operators[op]++
+		}
+		topic, _ := strconv.ParseInt(q.TopicId, 10, 64)
+		q.NewPooled = len(added[q.QueryId])
+		for _, id := range added[q.QueryId] {
+			doc, _ := strconv.ParseInt(id, 10, 64)
+			if relevant[judgmentKey{topic, doc, q.userId}] {
+				q.NewRelevant++
+			}
+		}
+		report.Queries = append(report.Queries, q.QueryLogEntry)
+
+		day := q.Date.Format("2006-01-02")
+		if _, ok := topicDays[q.TopicId]; !ok {
+			topicDays[q.TopicId] = map[string]*queryGroupCounts{}
+		}
+		if _, ok := userDays[q.User]; !ok {
+			userDays[q.User] = map[string]*queryGroupCounts{}
+		}
+		for _, g := range []struct{ groups map[string]*queryGroupCounts; key string }{
+			{byTopic, q.TopicId}, {byUser, q.User}, {byDay, day},
+			{topicDays[q.TopicId], day}, {userDays[q.User], day}} {
+			c, ok := g.groups[g.key]
+			if !ok {
+				c = &queryGroupCounts{topics: map[string]bool{}, users: map[string]bool{}}
+				g.groups[g.key] = c
+			}
+			c.add(q.QueryLogEntry)
+		}
+	}
+
+	report.Topics = queryGroups(byTopic)
+	sort.Slice(report.Topics, func(a, b int) bool {
+		x, _ := strconv.Atoi(report.Topics[a].Key)
+		y, _ := strconv.Atoi(report.Topics[b].Key)
+		return x < y
+	})
+	report.Users = queryGroups(byUser)
+	report.Days = queryGroups(byDay)
+	for t, days := range topicDays {
+		report.TopicDays[t] = queryGroups(days)
+	}
+	for u, days := range userDays {
+		report.UserDays[u] = queryGroups(days)
+	}
+	return report, nil
+}
+
+type queryGroupCounts struct {
+
+	queries, withResults, results, newPooled, newRelevant int
+
+	topics, users map[string]bool
+
+}
+
+func (c *queryGroupCounts) add(q QueryLogEntry) {
+	c.queries++
+	if q.Results != nil {
+		c.withResults++
+		c.results += *q.Results
+	}
+	c.newPooled += q.NewPooled
+	c.newRelevant += q.NewRelevant
+	c.topics[q.TopicId] = true
+	c.users[q.User] = true
+}
+
+// Groups sorted by key.
+func queryGroups(groups map[string]*queryGroupCounts) []QueryGroup {
+	res := make([]QueryGroup, 0, len(groups))
+	for k, c := range groups {
+		res = append(res, QueryGroup{
+			Key: k,
+			Queries: c.queries,
+			Topics: len(c.topics),
+			Users: len(c.users),
+			MeanResults: ratio(c.results, c.withResults),
+			NewPooled: c.newPooled,
+			NewRelevant: c.newRelevant,
+		})
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Key < res[b].Key })
+	return res
+}
+
+type queryLogRow struct {
+
+	QueryLogEntry
+
+	userId int64
+
+}
+
+func dbGetQueryLog(db *sql.DB) ([]queryLogRow, error) {
+	rows, err := db.Query(`SELECT q.query_id, q.topic_id, q.user_id, u.name, q.date_added, q.query, s.total_hits
+		FROM query q JOIN users u ON u.user_id = q.user_id
+		LEFT JOIN pool_source s ON s.query_id = q.query_id
+		ORDER BY q.query_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	log := make([]queryLogRow, 0)
+	for rows.Next() {
+		var q queryLogRow
+		var date sql.NullTime
+		var results sql.NullInt64
+		err = rows.Scan(&q.QueryId, &q.TopicId, &q.userId, &q.User, &date, &q.Query, &results)
+		if err != nil {
+			return nil, err
+		}
+		q.Date = date.Time
+		if results.Valid {
+			n := int(results.Int64)
+			q.Results = &n
+		}
+		log = append(log, q)
+	}
+	return log, rows.Err()
+}
+
+// Every pool source with its documents, in the order added.
+func dbGetAllPoolSources(db *sql.DB) ([]poolSource, error) {
+	rows, err := db.Query(`SELECT s.source_id, s.topic_id, s.user_id, COALESCE(s.query_id, 0), p.doc_id
+		FROM pool_source s LEFT JOIN pool p ON p.source_id = s.source_id
+		ORDER BY s.source_id, p.rank`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	sources := make([]poolSource, 0)
+	for rows.Next() {
+		var s poolSource
+		var doc sql.NullInt64
+		err = rows.Scan(&s.SourceId, &s.TopicId, &s.UserId, &s.QueryId, &doc)
+		if err != nil {
+			return nil, err
+		}
+		if n := len(sources); n == 0 || sources[n - 1].SourceId != s.SourceId {
+			sources = append(sources, s)
+		}
+		if doc.Valid {
+			last := &sources[len(sources) - 1]
+			last.Docs = append(last.Docs, strconv.FormatInt(doc.Int64, 10))
+		}
+	}
+	return sources, rows.Err()
+}
+
+// Query log handlers ------------------------------------------------------------
+
+func queryLogViewHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	i.templates["querylog"].Execute(w, nil)
+	return 200, nil
+}
+
+// GET /admin/queries/data?topics=1,2&user=name
+func queryLogHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	report, err := i.queryLogReport(parseFilter(r.FormValue("topics")), strings.ToLower(r.FormValue("user")))
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(report)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Runs from participating systems are imported into topic pools as shared
+// sources, the top topics.run_depth documents (pool_depth if unset) of each
+// topic the run has results for. Each pool document records the runs and
+// queries that retrieved it, importing a run again replaces it, and
+// rebuild-pools keeps imported runs.
+func (i *Instance) runDepth() int {
+	if i.config.Topics.RunDepth > 0 {
+		return i.config.Topics.RunDepth
+	}
+	return i.config.Topics.PoolDepth
+}
+
+// Adds the run to the pools of the topics, all topics if topics is empty,
+// returning the topics and documents added. A run with non-numeric document
+// ids is rejected, and a run imported again is replaced for all of the topics
+// at once, or not at all.
+func (i *Instance) importRun(run *trecRun, depth int, topics map[string]bool) (int, int, error) {
+	if depth <= 0 {
+		depth = i.runDepth()
+	}
+	ids := make([]string, 0, len(run.Topics))
+	for t := range run.Topics {
+		if _, ok := i.topics[t]; ok && (len(topics) == 0 || topics[t]) {
+			ids = append(ids, t)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, t := range ids {
+		for _, d := range run.Topics[t] {
+			if _, err := strconv.ParseInt(d.Id, 10, 64); err != nil {
+				return 0, 0, fmt.Errorf("Run %s, topic %s: document id %q is not numeric", run.Name, t, d.Id)
+			}
+		}
+	}
+
+	// Topics are locked in id order, no other path holds more than one.
+	nums := make([]int64, len(ids))
+	for j, t := range ids {
+		topic, err := strconv.ParseInt(t, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		nums[j] = topic
+		lock := poolLock(topic)
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	sources := make([]poolSource, len(ids))
+	for j, t := range ids {
+		s := poolSource{TopicId: nums[j], Run: run.Name, Query: run.Name, TotalHits: len(run.Topics[t])}
+		for r, d := range run.Topics[t] {
+			if r >= depth {
+				break
+			}
+			s.Docs = append(s.Docs, d.Id)
+			s.Scores = append(s.Scores, d.Score)
+		}
+		sources[j] = s
+	}
+	docs, err := dbReplaceRun(i.db, run.Name, sources, time.Now())
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(ids), docs, nil
+}
+
+// Replaces the run's source for each topic in one transaction, returning the
+// documents pooled.
+func dbReplaceRun(db *sql.DB, run string, sources []poolSource, date time.Time) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	docs := 0
+	for _, s := range sources {
+		_, err = tx.Exec("DELETE FROM pool_source WHERE topic_id = $1 AND run = $2", s.TopicId, run)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n, err := dbSavePoolSource(tx, s.TopicId, s, date)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		docs += n
+	}
+	return docs, tx.Commit()
+}
+
+// Run contribution ----------------------------------------------------------------
+
+type RunContribution struct {
+
+	Run string `json:"run"`
+
+	Topics int `json:"topics"`
+
+	// Pool documents the run retrieved, and those no query or other run did.
+	Pooled int `json:"pooled"`
+
+	Unique int `json:"unique"`
+
+	// Of the pooled documents, those judged and those judged relevant (the
+	// majority grade above the lowest grade).
+	Judged int `json:"judged"`
+
+	Relevant int `json:"relevant"`
+
+	UniqueRelevant int `json:"unique_relevant"`
+
+}
+
+func (i *Instance) runContributions() ([]RunContribution, error) {
+	rows, err := dbGetPoolContributors(i.db)
+	if err != nil {
+		return nil, err
+	}
+	judged, err := i.evalQrels(evalOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	type docKey struct{ topic, doc int64 }
+	sources := map[docKey]int{}
+	for _, r := range rows {
+		sources[docKey{r.topic, r.doc}]++
+	}
+
+	byRun := map[string]*RunContribution{}
+	topics := map[string]map[int64]bool{}
+	for _, r := range rows {
+		if r.run == "" {
+			continue
+		}
+		c, ok := byRun[r.run]
+		if !ok {
+			c = &RunContribution{Run: r.run}
+			byRun[r.run] = c
+			topics[r.run] = map[int64]bool{}
+		}
+		topics[r.run][r.topic] = true
+		unique := sources[docKey{r.topic, r.doc}] == 1
+		c.Pooled++
+		if unique {
+			c.Unique++
+		}
+		g, ok := judged[strconv.FormatInt(r.topic, 10)][strconv.FormatInt(r.doc, 10)]
+		if !ok {
+			continue
+		}
+		c.Judged++
+		if g > 0 {
+			c.Relevant++
+			if unique {
+				c.UniqueRelevant++
+			}
+		}
+	}
+
+	res := make([]RunContribution, 0, len(byRun))
+	for run, c := range byRun {
+		c.Topics = len(topics[run])
+		res = append(res, *c)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Run < res[b].Run })
+	return res, nil
+}
+
+type poolContributor struct{ topic, doc int64; run string }
+
+// Every (topic, doc, source) in the pools, queries and searches having an
+// empty run. A document retrieved twice by the same source is counted once.
+func dbGetPoolContributors(db *sql.DB) ([]poolContributor, error) {
+	rows, err := db.Query(`SELECT DISTINCT p.topic_id, p.doc_id, s.source_id, COALESCE(s.run, '')
+		FROM pool p JOIN pool_source s ON s.source_id = p.source_id`)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	res := make([]poolContributor, 0)
+	for rows.Next() {
+		var c poolContributor
+		var source int64
+		err = rows.Scan(&c.topic, &c.doc, &source, &c.run)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// Run handlers ----------------------------------------------------------------
+
+// POST /admin/pools/runs?depth=20&topics=1,2 with run files uploaded as
+// multipart field runs.
+func apiImportRuns(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	if i.byList {
+		return 400, fmt.Errorf("Pools are read from the document list")
+	}
+	err = r.ParseMultipartForm(32 << 20)
+	if err != nil {
+		return 400, err
+	}
+	files := r.MultipartForm.File["runs"]
+	if len(files) == 0 {
+		return 400, errors.New("No run files uploaded")
+	}
+	depth := 0
+	if d := r.FormValue("depth"); d != "" {
+		depth, err = strconv.Atoi(d)
+		if err != nil {
+			return 400, err
+		}
+	}
+	topics := parseFilter(r.FormValue("topics"))
+
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			return 400, err
+		}
+		run, err := readRun(f, fh.Filename)
+		f.Close()
+		if err != nil {
+			return 400, err
+		}
+		n, docs, err := i.importRun(run, depth, topics)
+		if err != nil {
+			return 500, err
+		}
+		log.Printf("user %d - imported run %s, %d documents for %d topics.\n", auth, run.Name, docs, n)
+	}
+	return runContributionHandler(i, w, r)
+}
+
+// GET /admin/pools/runs
+func runContributionHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	c, err := i.runContributions()
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(c)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func importRunsCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("import-runs", flag.ExitOnError)
+	depth := fs.Int("depth", 0, "Documents pooled per topic [if 0 then topics.run_depth from config]")
+	topics := fs.String("topics", "", "Comma separated topic ids [if empty then all]")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("Usage: import-runs [-depth n] [-topics 1,2] run...")
+	}
+
+	for _, path := range fs.Args() {
+		run, err := readRunFile(path)
+		if err != nil {
+			return err
+		}
+		n, docs, err := i.importRun(run, *depth, parseFilter(*topics))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%d topics\t%d documents\n", run.Name, n, docs)
+	}
+	return nil
+}
@@ -15,8 +15,6 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
-
-	elastic "github.com/danlocke/elastic-go"
 )
 
 const CONFIG_PATH string = "config.json"
@@ -43,8 +41,22 @@ type Config struct {
 
 		IndexName string `json:"index_name"`
 
+		// Index field names, defaults to the CourtListener names.
+		Fields esFieldMapping `json:"fields"`
+
 	} `json:"elastic"`
 
+	Store struct {
+
+		// elastic (default) or local.
+		Type string `json:"type"`
+
+		// For local, a directory of CourtListener opinion .json/.jsonl files
+		// or a single file.
+		Path string `json:"path"`
+
+	} `json:"store"`
+
 	Server struct {
 
 		Address             string    `json:"address"`
@@ -75,8 +87,56 @@ type Config struct {
 
 		PoolDepth 	 int `json:"pool_depth"`
 
+		// How pooled documents are ordered, see pooling.go.
+		Pooling string `json:"pooling"`
+
+		// Largest pool, 0 for no limit.
+		PoolSize int `json:"pool_size"`
+
+		// Documents pooled from each imported run per topic, defaults to
+		// pool_depth.
+		RunDepth int `json:"run_depth"`
+
+		// k for reciprocal rank fusion, defaults to 60.
+		RRFK float64 `json:"rrf_k"`
+
+		// Number of assessors allocated to each topic.
+		Overlap      int `json:"overlap"`
+
+		// Share of the pool size to add as control documents, known relevant
+		// cited cases, see controls.go. 0 adds none.
+		ControlFraction float64 `json:"control_fraction"`
+
+		// Show unjudged pool documents most likely relevant first, see
+		// cal.go.
+		ActiveLearning bool `json:"active_learning"`
+
 	} `json:"topics"`
 
+	Qrels struct {
+
+		// assessType label to graded relevance, ie. {"on point": 3}.
+		Grades map[string]int `json:"grades"`
+
+	} `json:"qrels"`
+
+	Stopping struct {
+
+		// Relevant documents the target method samples for, defaults to 10.
+		TargetSize int `json:"target_size"`
+
+		// Recall the quantile method stops at, defaults to 0.8.
+		Recall float64 `json:"recall"`
+
+	} `json:"stopping"`
+
+	Tags struct {
+
+		// Categories a tag can be given, defaults to defaultTagCategories.
+		Categories []string `json:"categories"`
+
+	} `json:"tags"`
+
 }
 
 
@@ -88,11 +148,7 @@ type Instance struct {
 
 	db *sql.DB
 
-	es *elastic.Client
-
-	searchIndex string
-
-	docType string
+	docs DocumentStore
 
 	topics map[string]Topic
 
@@ -108,6 +164,8 @@ type Instance struct {
 
 	config Config
 
+	ranker *calRanker
+
 }
 
 type handler struct {
@@ -120,17 +178,25 @@ type handler struct {
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if status, err := h.H(h.Instance, w, r); err != nil {
-		log.Println(err)
-		switch status {
-			case http.StatusNotFound:
-				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-			case http.StatusUnauthorized:
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-			case http.StatusInternalServerError:
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			default:
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		}
+		h.error(w, status, err)
+	}
+}
+
+func (h handler) error(w http.ResponseWriter, status int, err error) {
+	log.Println(err)
+	switch status {
+		case http.StatusBadRequest:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		case http.StatusNotFound:
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		case http.StatusUnauthorized:
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		case http.StatusForbidden:
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		case http.StatusInternalServerError:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		default:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
@@ -145,7 +211,7 @@ func initInstance() (*Instance, error) {
 		return nil, err
 	}
 
-	es, err := elastic.New()
+	docs, err := newDocumentStore(c)
 	if err != nil {
 		return nil, err
 	}
@@ -165,14 +231,13 @@ func initInstance() (*Instance, error) {
 	return &Instance{
 		dir: dir,
 		db: db,
-		es: es,
+		docs: docs,
 		startTime: time.Now(),
-		searchIndex: c.Elastic.IndexName,
-		docType: c.Elastic.DocType,
 		topics: nil,
 		templates: make(map[string]*template.Template),
 		store: sessions.NewCookieStore(key),
 		config: *c,
+		ranker: newCalRanker(),
 	}, nil
 }
 
@@ -195,34 +260,72 @@ func (i *Instance) router() *mux.Router {
 	gets := r.Methods("GET").Subrouter()
 	posts := r.Methods("POST").Subrouter()
 	deletes := r.Methods("DELETE").Subrouter()
+	puts := r.Methods("PUT").Subrouter()
 
 	// Views -------------------------------------------------------------------
 	gets.Handle("/login", handler{i, loginViewHandler})
 	posts.Handle("/lgh", handler{i, loginHandler})
-	gets.Handle("/", handler{i, indexViewHandler})
-	gets.Handle("/info", handler{i, infoViewHandler})
+	gets.Handle("/", i.allow(indexViewHandler, anyRole...))
+	gets.Handle("/info", i.allow(infoViewHandler, anyRole...))
 
 	// Decision
-	gets.Handle("/decision/{docId}", handler{i, decisionViewHandler})
-	gets.Handle("/ddata/{docId}", handler{i, decisionHandler})
+	gets.Handle("/decision/{docId}", i.allow(decisionViewHandler, anyRole...))
+	gets.Handle("/ddata/{docId}", i.allow(decisionHandler, anyRole...))
 
 	// Topics  -----------------------------------------------------------------
-	gets.Handle("/topics", handler{i, topicIndexViewHandler})
-	gets.Handle("/data", handler{i, topicIndexDataHandler})
-	gets.Handle("/topic/{topicId}", handler{i, topicViewHandler})
-	gets.Handle("/data/{topicId}", handler{i, topicDataHandler})
-	gets.Handle("/tdata/{topicId}/{docId}", handler{i, topicDecisionHandler})
+	gets.Handle("/topics", i.allow(topicIndexViewHandler, anyRole...))
+	gets.Handle("/data", i.allow(topicIndexDataHandler, anyRole...))
+	gets.Handle("/topic/{topicId}", i.allow(topicViewHandler, anyRole...))
+	gets.Handle("/data/{topicId}", i.allow(topicDataHandler, anyRole...))
+	gets.Handle("/data/{topicId}/ranking", i.allow(topicRankingHandler, anyRole...))
+	gets.Handle("/data/{topicId}/stopping", i.allow(topicStoppingHandler, anyRole...))
+	gets.Handle("/tdata/{topicId}/{docId}", i.allow(topicDecisionHandler, anyRole...))
 
 	// Database functions ------------------------------------------------------
-	gets.Handle("/tags/{topicId}/{docId}", handler{i, getTagHandler})
-	posts.Handle("/tag", handler{i, apiSaveTag})
-	deletes.Handle("/tag", handler{i, apiDeleteTag})
+	gets.Handle("/tags/{topicId}/{docId}", i.allow(getTagHandler, anyRole...))
+	posts.Handle("/tag", i.allow(apiSaveTag, writeRoles...))
+	deletes.Handle("/tag", i.allow(apiDeleteTag, writeRoles...))
+	posts.Handle("/tag/restore", i.allow(apiRestoreTag, writeRoles...))
+	puts.Handle("/tag/{id:[0-9]+}", i.allow(apiEditTag, writeRoles...))
+	gets.Handle("/tag/{id:[0-9]+}/history", i.allow(tagHistoryHandler, anyRole...))
 
 	 // Searching functions ----------------------------------------------------
-	posts.Handle("/search", handler{i, apiSearch})
+	posts.Handle("/search", i.allow(apiSearch, writeRoles...))
 
 	// Asesssments  ------------------------------------------------------------
-	posts.Handle("/assess", handler{i, apiAssessTopic})
+	posts.Handle("/assess", i.allow(apiAssessTopic, writeRoles...))
+	gets.Handle("/admin/history/{topicId}", i.allow(assessmentHistoryHandler, adminRoles...))
+
+	// Allocation --------------------------------------------------------------
+	gets.Handle("/admin/assignments", i.allow(assignmentsHandler, adminRoles...))
+	posts.Handle("/admin/allocate", i.allow(apiAllocateTopics, adminRoles...))
+	posts.Handle("/admin/reassign", i.allow(apiReassignTopic, adminRoles...))
+	posts.Handle("/admin/pools/rebuild", i.allow(apiRebuildPools, adminRoles...))
+	posts.Handle("/admin/pools/runs", i.allow(apiImportRuns, adminRoles...))
+	gets.Handle("/admin/pools/runs", i.allow(runContributionHandler, adminRoles...))
+
+	// Exports -----------------------------------------------------------------
+	gets.Handle("/export/qrels", i.allow(exportQrelsHandler, adminRoles...))
+	gets.Handle("/export/passages", i.allow(exportPassagesHandler, adminRoles...))
+
+	// Evaluation --------------------------------------------------------------
+	posts.Handle("/admin/evaluate", i.allow(apiEvaluateRuns, adminRoles...))
+
+	// Adjudication ------------------------------------------------------------
+	gets.Handle("/adjudicate/queue/{topicId}", i.allow(adjudicationQueueHandler, adjudicateRoles...))
+	gets.Handle("/adjudicate/{topicId}/{docId}", i.allow(adjudicationDocHandler, adjudicateRoles...))
+	posts.Handle("/adjudicate", i.allow(apiAdjudicate, adjudicateRoles...))
+
+	// Reports -----------------------------------------------------------------
+	gets.Handle("/admin/agreement", i.allow(agreementViewHandler, adminRoles...))
+	gets.Handle("/admin/agreement/data", i.allow(agreementHandler, adminRoles...))
+	gets.Handle("/admin/agreement/tags", i.allow(tagAgreementHandler, adminRoles...))
+	gets.Handle("/admin/extracts", i.allow(extractReportHandler, adminRoles...))
+	gets.Handle("/admin/controls", i.allow(controlReportHandler, adminRoles...))
+	gets.Handle("/admin/stopping", i.allow(stoppingViewHandler, adminRoles...))
+	gets.Handle("/admin/stopping/data", i.allow(stoppingHandler, adminRoles...))
+	gets.Handle("/admin/queries", i.allow(queryLogViewHandler, adminRoles...))
+	gets.Handle("/admin/queries/data", i.allow(queryLogHandler, adminRoles...))
 
 	gets.PathPrefix(i.config.Server.StaticFileLocation).Handler(
 		http.StripPrefix(i.config.Server.StaticFileLocation,
@@ -250,13 +353,19 @@ Search classifier
 	byDocList := flag.String("d", "", "Load doc list and judge only given docs [if empty then no]")
 	flag.Parse()
 
-	topics, err := loadTopics(instance.dir, instance.config.Topics.Location,
-		instance.config.Topics.DataFileName, *loadTopic, *updateTopics)
+	if flag.NArg() > 0 {
+		err = runCommand(instance, flag.Args(), *loadTopic, *updateTopics)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = instance.initTopics(*loadTopic, *updateTopics)
 	if err != nil {
 		log.Panic(err)
 	}
 	log.Println("topics loaded.")
-	instance.topics = *topics
 	// // err = instance.getNumResultsForManualQueries()
 	// // if err != nil {
 	// // 	log.Panic(err)
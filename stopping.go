@@ -0,0 +1,471 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Stopping rules estimate whether an assessor has found enough of a topic's
+// relevant documents to stop. Relevant is anything judged above the lowest
+// grade. Each rule works from the assessor's judgments and their ranked pool:
+// the order they are shown documents in, or with active learning every pool
+// document ordered by the topic's model.
+//
+// - Knee (Cormack and Grossman 2016): the gain curve of relevant documents
+//   found against documents judged, in the order they were first judged. The
+//   knee is the point furthest from the line joining the curve's ends, and
+//   review can stop once the slope before the knee is at least
+//   kneeRatio - min(relevant found, kneeRelevantCap) times the slope after it
+//   with at least kneeMinJudged judged.
+//
+// - Target (Cormack and Grossman 2016): a random sample of the pool is judged
+//   until stopping.target_size relevant documents are found. Review can stop
+//   once every document ranked above the lowest ranked of these is judged.
+//
+// - Quantile: the rate of relevant documents among the last quantileWindow
+//   judged is taken as the rate among those not judged, with a Jeffreys
+//   (Beta) posterior. Recall is estimated at its median and 5% and 95%
+//   quantiles, review can stop once the 5% quantile reaches stopping.recall.
+const (
+	kneeRatio = 156.0
+
+	kneeRelevantCap = 150
+
+	kneeMinJudged = 150
+
+	defaultTargetSize = 10
+
+	defaultStoppingRecall = 0.8
+
+	quantileWindow = 50
+)
+
+type StoppingEstimate struct {
+
+	TopicId string `json:"topic"`
+
+	Assessor string `json:"assessor"`
+
+	// Documents in the ranked pool, judged, and judged relevant.
+	Pool int `json:"pool"`
+
+	Judged int `json:"judged"`
+
+	Relevant int `json:"relevant"`
+
+	// Judgments to the knee, 0 if there is none yet.
+	KneeJudged int `json:"knee_judged"`
+
+	KneeRatio stat `json:"knee_ratio"`
+
+	// The ratio needed to stop, lower as more relevant documents are found.
+	KneeThreshold float64 `json:"knee_threshold"`
+
+	KneeStop bool `json:"knee_stop"`
+
+	TargetSize int `json:"target_size"`
+
+	// Relevant documents found in the sample so far, and sample documents
+	// judged.
+	TargetFound int `json:"target_found"`
+
+	SampleJudged int `json:"sample_judged"`
+
+	// The sample document to judge next, if the target isn't complete.
+	NextSample string `json:"next_sample,omitempty"`
+
+	// Rank of the lowest ranked target document, 0 until the target is
+	// complete.
+	TargetRank int `json:"target_rank"`
+
+	TargetStop bool `json:"target_stop"`
+
+	Recall stat `json:"recall"`
+
+	RecallLow stat `json:"recall_low"`
+
+	RecallHigh stat `json:"recall_high"`
+
+	QuantileStop bool `json:"quantile_stop"`
+
+}
+
+// A judgment in the order the assessor first made it.
+type reviewedDoc struct {
+
+	Id string
+
+	Relevant bool
+
+}
+
+func (i *Instance) stoppingTargetSize() int {
+	if i.config.Stopping.TargetSize > 0 {
+		return i.config.Stopping.TargetSize
+	}
+	return defaultTargetSize
+}
+
+func (i *Instance) stoppingRecall() float64 {
+	if i.config.Stopping.Recall > 0 {
+		return i.config.Stopping.Recall
+	}
+	return defaultStoppingRecall
+}
+
+// The user's pool for the topic in rank order, as persisted. Estimates don't
+// search, anything not yet pooled is counted once the assessor loads the topic.
+func (i *Instance) rankedPool(userId int64, topicId string) ([]string, error) {
+	_, hits, err := i.topicHits(userId, topicId, false)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(hits))
+	for j, h := range hits {
+		ids[j] = h.Id
+	}
+	if !i.config.Topics.ActiveLearning {
+		return ids, nil
+	}
+	scores, err := i.calScores(topicId, ids)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ids, func(a, b int) bool { return scores[ids[a]] > scores[ids[b]] })
+	return ids, nil
+}
+
+func (i *Instance) stoppingEstimate(userId int64, topicId string) (*StoppingEstimate, error) {
+	topic, err := strconv.ParseInt(topicId, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	ranking, err := i.rankedPool(userId, topicId)
+	if err != nil {
+		return nil, err
+	}
+	reviewed, err := dbGetReviewOrder(i.db, topic, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, _ := i.gradeLabels()
+	grades := i.grades()
+	judged := map[string]bool{}
+	seq := make([]reviewedDoc, len(reviewed))
+	for j, a := range reviewed {
+		seq[j] = reviewedDoc{strconv.FormatInt(a.DocId, 10), grades[a.Relevance] > grades[labels[0]]}
+		judged[seq[j].Id] = seq[j].Relevant
+	}
+
+	e := &StoppingEstimate{TopicId: topicId, Pool: len(ranking), Judged: len(seq), TargetSize: i.stoppingTargetSize()}
+	for _, d := range seq {
+		if d.Relevant {
+			e.Relevant++
+		}
+	}
+	e.KneeJudged, e.KneeRatio = knee(seq)
+	e.KneeThreshold = kneeThreshold(e.Relevant)
+	e.KneeStop = e.Judged >= kneeMinJudged && !math.IsNaN(float64(e.KneeRatio)) && float64(e.KneeRatio) >= e.KneeThreshold
+
+	targetRule(e, ranking, judged, topicSeed(topicId))
+
+	unjudged := 0
+	for _, id := range ranking {
+		if _, ok := judged[id]; !ok {
+			unjudged++
+		}
+	}
+	e.Recall, e.RecallLow, e.RecallHigh = recallQuantiles(seq, unjudged)
+	e.QuantileStop = !math.IsNaN(float64(e.RecallLow)) && float64(e.RecallLow) >= i.stoppingRecall()
+	return e, nil
+}
+
+func kneeThreshold(relevant int) float64 {
+	if relevant > kneeRelevantCap {
+		relevant = kneeRelevantCap
+	}
+	return kneeRatio - float64(relevant)
+}
+
+// The knee of the gain curve and the slope ratio there.
+func knee(seq []reviewedDoc) (int, stat) {
+	n := len(seq)
+	gain := make([]int, n + 1)
+	for j, d := range seq {
+		gain[j + 1] = gain[j]
+		if d.Relevant {
+			gain[j + 1]++
+		}
+	}
+	if n == 0 || gain[n] == 0 {
+		return 0, stat(math.NaN())
+	}
+
+	// Distance from (x, gain[x]) to the line from (0, 0) to (n, gain[n]),
+	// up to a constant.
+	at, best := 0, -1.0
+	for x := 1; x < n; x++ {
+		d := math.Abs(float64(gain[n]) * float64(x) - float64(n) * float64(gain[x]))
+		if d > best {
+			at, best = x, d
+		}
+	}
+	if at == 0 {
+		return 0, stat(math.NaN())
+	}
+	before := float64(gain[at]) / float64(at)
+	after := float64(gain[n] - gain[at] + 1) / float64(n - at)
+	return at, stat(before / after)
+}
+
+// Walks a seeded random sample of the ranked pool until it has enough
+// relevant documents or reaches one not judged.
+func targetRule(e *StoppingEstimate, ranking []string, judged map[string]bool, seed int64) {
+	sample := append([]string{}, ranking...)
+	sort.Strings(sample)
+	rnd := rand.New(rand.NewSource(seed))
+	rnd.Shuffle(len(sample), func(a, b int) { sample[a], sample[b] = sample[b], sample[a] })
+
+	target := map[string]bool{}
+	for _, id := range sample {
+		if e.TargetFound >= e.TargetSize {
+			break
+		}
+		relevant, ok := judged[id]
+		if !ok {
+			e.NextSample = id
+			return
+		}
+		e.SampleJudged++
+		if relevant {
+			e.TargetFound++
+			target[id] = true
+		}
+	}
+
+	// The sample is complete, or the whole pool is judged with fewer
+	// relevant documents than the target.
+	for r, id := range ranking {
+		if target[id] {
+			e.TargetRank = r + 1
+		}
+	}
+	e.TargetStop = true
+	for _, id := range ranking[:e.TargetRank] {
+		if _, ok := judged[id]; !ok {
+			e.TargetStop = false
+			break
+		}
+	}
+}
+
+// Recall at the median and the 5% and 95% quantiles of the rate of relevant
+// documents among those not judged.
+func recallQuantiles(seq []reviewedDoc, unjudged int) (stat, stat, stat) {
+	found := 0
+	for _, d := range seq {
+		if d.Relevant {
+			found++
+		}
+	}
+	window := seq
+	if len(window) > quantileWindow {
+		window = window[len(window) - quantileWindow:]
+	}
+	if len(window) == 0 {
+		return stat(math.NaN()), stat(math.NaN()), stat(math.NaN())
+	}
+	r := 0
+	for _, d := range window {
+		if d.Relevant {
+			r++
+		}
+	}
+	a, b := float64(r) + 0.5, float64(len(window) - r) + 0.5
+	recall := func(q float64) stat {
+		missed := betaQuantile(a, b, q) * float64(unjudged)
+		if float64(found) + missed == 0 {
+			return stat(math.NaN())
+		}
+		return stat(float64(found) / (float64(found) + missed))
+	}
+	// A higher rate means more missed and lower recall.
+	return recall(0.5), recall(0.95), recall(0.05)
+}
+
+// The q quantile of Beta(a, b), by bisection.
+func betaQuantile(a, b, q float64) float64 {
+	lo, hi := 0.0, 1.0
+	for n := 0; n < 60; n++ {
+		mid := (lo + hi) / 2
+		if betaInc(a, b, mid) < q {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// The regularised incomplete beta function I_x(a, b), from its continued
+// fraction (Numerical Recipes 6.4).
+func betaInc(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a * math.Log(x) + b * math.Log(1 - x))
+	if x < (a + 1) / (a + b + 2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front * betaFraction(b, a, 1 - x) / b
+}
+
+func betaFraction(a, b, x float64) float64 {
+	const tiny = 1e-30
+	c, d := 1.0, 1 - (a + b) * x / (a + 1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 200; m++ {
+		fm := float64(m)
+		for k := 0; k < 2; k++ {
+			var num float64
+			if k == 0 {
+				num = fm * (b - fm) * x / ((a + 2 * fm - 1) * (a + 2 * fm))
+			} else {
+				num = -(a + fm) * (a + b + fm) * x / ((a + 2 * fm) * (a + 2 * fm + 1))
+			}
+			d = 1 + num * d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num / c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+			if k == 1 && math.Abs(d * c - 1) < 1e-12 {
+				return h
+			}
+		}
+	}
+	return h
+}
+
+// The user's current judgments for the topic, in the order each document
+// was first judged.
+func dbGetReviewOrder(db *sql.DB, topic, user int64) ([]Assessment, error) {
+	rows, err := db.Query(`SELECT a.doc_id, a.relevant, COALESCE(MIN(h.date_assessed), a.date_assessed) AS first
+		FROM assessment a LEFT JOIN assessment_history h
+		ON h.topic_id = a.topic_id AND h.doc_id = a.doc_id AND h.assessor = a.assessor
+		WHERE a.topic_id = $1 AND a.assessor = $2 AND a.relevant IS NOT NULL
+		GROUP BY a.doc_id, a.relevant, a.date_assessed
+		ORDER BY first, a.doc_id`, topic, user)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	assessments := make([]Assessment, 0)
+	for rows.Next() {
+		a := Assessment{TopicId: topic, UserId: user}
+		err = rows.Scan(&a.DocId, &a.Relevance, &a.Date)
+		if err != nil {
+			return nil, err
+		}
+		assessments = append(assessments, a)
+	}
+	return assessments, rows.Err()
+}
+
+// Stopping handlers -------------------------------------------------------------
+
+// GET /data/{topicId}/stopping - the user's estimate for the topic.
+func topicStoppingHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	if auth < 0 {
+		return 401, errors.New("Unauthorized")
+	}
+	topicId := mux.Vars(r)["topicId"]
+	ok, err := i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
+	e, err := i.stoppingEstimate(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(e)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+func stoppingViewHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	i.templates["stopping"].Execute(w, nil)
+	return 200, nil
+}
+
+// GET /admin/stopping/data - estimates for every assignment with judgments.
+func stoppingHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	assignments, err := dbGetAssignments(i.db)
+	if err != nil {
+		return 500, err
+	}
+	counts := map[int64]map[string]int{}
+	estimates := []StoppingEstimate{}
+	for _, a := range assignments {
+		if _, ok := i.topics[a.TopicId]; !ok {
+			continue
+		}
+		if _, ok := counts[a.UserId]; !ok {
+			counts[a.UserId], err = dbGetNumberAssessedPerTopic(i.db, a.UserId)
+			if err != nil {
+				return 500, err
+			}
+		}
+		if counts[a.UserId][a.TopicId] == 0 {
+			continue
+		}
+		e, err := i.stoppingEstimate(a.UserId, a.TopicId)
+		if err != nil {
+			return 500, err
+		}
+		e.Assessor = a.Name
+		estimates = append(estimates, *e)
+	}
+	buff, err := json.Marshal(estimates)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Judgments from a string of r (relevant) and n (not).
+func reviewed(s string) []reviewedDoc {
+	seq := make([]reviewedDoc, len(s))
+	for j, c := range s {
+		seq[j] = reviewedDoc{string('a' + rune(j)), c == 'r'}
+	}
+	return seq
+}
+
+func TestKnee(t *testing.T) {
+	tests := []struct {
+
+		seq string
+
+		at int
+
+		ratio float64
+
+	}{
+		// Three relevant then seven not: the knee is at 3, slope 1 before
+		// and (0 + 1) / 7 after.
+		{"rrrnnnnnnn", 3, 7},
+		{"rnrnnnnn", 3, 2.0 / 3 / (1.0 / 5)},
+		// A straight line has no furthest point, the first is taken.
+		{"rrrr", 1, 1 / (4.0 / 3)},
+		{"", 0, math.NaN()},
+		{"nnnn", 0, math.NaN()},
+		{"r", 0, math.NaN()},
+	}
+	for _, test := range tests {
+		at, ratio := knee(reviewed(test.seq))
+		if at != test.at {
+			t.Errorf("%q: knee at %d, want %d", test.seq, at, test.at)
+		}
+		if math.IsNaN(test.ratio) != math.IsNaN(float64(ratio)) ||
+			(!math.IsNaN(test.ratio) && math.Abs(float64(ratio) - test.ratio) > 1e-9) {
+			t.Errorf("%q: ratio %v, want %v", test.seq, ratio, test.ratio)
+		}
+	}
+}
+
+func TestKneeThreshold(t *testing.T) {
+	for _, test := range []struct{ relevant int; want float64 }{
+		{0, 156},
+		{10, 146},
+		{150, 6},
+		{500, 6},
+	} {
+		if got := kneeThreshold(test.relevant); got != test.want {
+			t.Errorf("kneeThreshold(%d): got %v, want %v", test.relevant, got, test.want)
+		}
+	}
+}
+
+func TestBetaQuantile(t *testing.T) {
+	tests := []struct {
+
+		a, b, q float64
+
+		want float64
+
+	}{
+		// Uniform.
+		{1, 1, 0.3, 0.3},
+		// CDF x^2.
+		{2, 1, 0.25, 0.5},
+		// CDF 1 - (1 - x)^2.
+		{1, 2, 0.75, 0.5},
+		// Jeffreys, CDF 2 / pi asin(sqrt(x)).
+		{0.5, 0.5, 0.25, math.Pow(math.Sin(math.Pi / 8), 2)},
+		{3, 3, 0.5, 0.5},
+		{5.5, 5.5, 0.5, 0.5},
+	}
+	for _, test := range tests {
+		if got := betaQuantile(test.a, test.b, test.q); math.Abs(got - test.want) > 1e-9 {
+			t.Errorf("betaQuantile(%v, %v, %v): got %v, want %v", test.a, test.b, test.q, got, test.want)
+		}
+	}
+
+	// I_0.4(2, 3) = P(at least 2 of 4 Bernoulli(0.4)).
+	if got := betaInc(2, 3, 0.4); math.Abs(got - 0.5248) > 1e-9 {
+		t.Errorf("betaInc(2, 3, 0.4): got %v, want 0.5248", got)
+	}
+}
+
+func TestRecallQuantiles(t *testing.T) {
+	// Half the window relevant, the median rate is a half, so as many are
+	// missed among ten unjudged as the five found.
+	mid, low, high := recallQuantiles(reviewed("rnrnrnrnrn"), 10)
+	if math.Abs(float64(mid) - 0.5) > 1e-9 {
+		t.Errorf("median recall %v, want 0.5", mid)
+	}
+	if !(low < mid && mid < high) {
+		t.Errorf("quantiles out of order: %v %v %v", low, mid, high)
+	}
+
+	// Nothing left to judge.
+	mid, low, high = recallQuantiles(reviewed("rrnnn"), 0)
+	if mid != 1 || low != 1 || high != 1 {
+		t.Errorf("got %v %v %v, want recall 1", mid, low, high)
+	}
+
+	mid, _, _ = recallQuantiles(nil, 10)
+	if !math.IsNaN(float64(mid)) {
+		t.Errorf("got %v with nothing judged, want NaN", mid)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	elastic "github.com/danlocke/elastic-go"
+)
+
+var errDocumentNotFound = errors.New("Document not found")
+
+// DocumentStore serves decisions and runs the Elasticsearch query DSL
+// produced for topics and searches. Stores other than Elasticsearch may
+// support only part of the DSL.
+type DocumentStore interface {
+
+	Get(id string) (*Decision, error)
+
+	// Returns the documents found, in the order of ids.
+	MultiGet(ids []string) ([]Decision, error)
+
+	Search(query []byte) (*SearchResult, error)
+
+	Count(query []byte) (int64, error)
+
+}
+
+type SearchResult struct {
+
+	Total int64
+
+	Hits []SearchHit
+
+}
+
+type SearchHit struct {
+
+	Id string
+
+	Score float64
+
+	Decision Decision
+
+}
+
+func newDocumentStore(c *Config) (DocumentStore, error) {
+	switch c.Store.Type {
+		case "", "elastic":
+			es, err := elastic.New()
+			if err != nil {
+				return nil, err
+			}
+			return &esStore{es, c.Elastic.IndexName, c.Elastic.DocType,
+				c.Elastic.Fields.withDefaults()}, nil
+		case "local":
+			return newLocalStore(c.Store.Path)
+		default:
+			return nil, fmt.Errorf("Unknown document store %q", c.Store.Type)
+	}
+}
+
+// Elasticsearch -----------------------------------------------------------------
+
+type esStore struct {
+
+	es *elastic.Client
+
+	index string
+
+	docType string
+
+	fields esFieldMapping
+
+}
+
+func (s *esStore) Get(id string) (*Decision, error) {
+	res, err := s.es.Get(s.index, s.docType, id)
+	if err != nil {
+		return nil, err
+	}
+	if res.Source == nil {
+		return nil, errDocumentNotFound
+	}
+	dec, err := s.fields.decode(res.Source)
+	if err != nil {
+		return nil, err
+	}
+	return &dec, nil
+}
+
+func (s *esStore) MultiGet(ids []string) ([]Decision, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"from": 0,
+		"size": len(ids),
+		"query": map[string]interface{}{
+			"ids": map[string]interface{}{
+				"values": ids,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.Search(query)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := map[string]Decision{}
+	for _, h := range res.Hits {
+		byId[h.Id] = h.Decision
+	}
+	docs := make([]Decision, 0, len(ids))
+	for _, id := range ids {
+		if d, ok := byId[id]; ok {
+			docs = append(docs, d)
+		}
+	}
+	return docs, nil
+}
+
+func (s *esStore) Search(query []byte) (*SearchResult, error) {
+	res, err := s.es.Search(s.index, query, "")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &SearchResult{
+		Total: int64(res.Hits.Total),
+		Hits: make([]SearchHit, len(res.Hits.Hits)),
+	}
+	for j, h := range res.Hits.Hits {
+		dec, err := s.fields.decode(h.Source)
+		if err != nil {
+			return nil, err
+		}
+		r.Hits[j] = SearchHit{Id: h.Id, Score: h.Score, Decision: dec}
+	}
+	return r, nil
+}
+
+func (s *esStore) Count(query []byte) (int64, error) {
+	res, err := s.es.Count(s.index, query)
+	if err != nil {
+		return 0, err
+	}
+	return int64(res.Count), nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"unicode"
+)
+
+// Passage agreement compares the tokens of a decision's plain text covered
+// by each assessor's tags, for documents judged by two or more assessors. An
+// assessor who judged a document but tagged nothing covers no tokens.
+type TagPairAgreement struct {
+
+	A string `json:"a"`
+
+	B string `json:"b"`
+
+	// Documents judged by both.
+	Docs int `json:"docs"`
+
+	// Tokens tagged by A, by B and by both.
+	TokensA int `json:"tokens_a"`
+
+	TokensB int `json:"tokens_b"`
+
+	TokensBoth int `json:"tokens_both"`
+
+	// B's tags measured against A's.
+	Precision stat `json:"precision"`
+
+	Recall stat `json:"recall"`
+
+	F1 stat `json:"f1"`
+
+	Jaccard stat `json:"jaccard"`
+
+}
+
+type TopicTagAgreement struct {
+
+	TopicId string `json:"topic"`
+
+	// Documents judged by two or more assessors.
+	Docs int `json:"docs"`
+
+	// Pooled over the topic's pairs.
+	F1 stat `json:"f1"`
+
+	Jaccard stat `json:"jaccard"`
+
+	Pairs []TagPairAgreement `json:"pairs"`
+
+}
+
+type TagAgreementReport struct {
+
+	// If set, only tags of this category were compared.
+	Category string `json:"category,omitempty"`
+
+	Topics []TopicTagAgreement `json:"topics"`
+
+	// Each assessor pair over all topics.
+	Pairs []TagPairAgreement `json:"pairs"`
+
+	F1 stat `json:"f1"`
+
+	Jaccard stat `json:"jaccard"`
+
+}
+
+// Token counts summed over documents.
+type tokenOverlap struct{ docs, a, b, both int }
+
+func (o *tokenOverlap) add(p tokenOverlap) {
+	o.docs += p.docs
+	o.a += p.a
+	o.b += p.b
+	o.both += p.both
+}
+
+func (o tokenOverlap) agreement(a, b string) TagPairAgreement {
+	return TagPairAgreement{
+		A: a,
+		B: b,
+		Docs: o.docs,
+		TokensA: o.a,
+		TokensB: o.b,
+		TokensBoth: o.both,
+		Precision: ratio(o.both, o.b),
+		Recall: ratio(o.both, o.a),
+		F1: ratio(2 * o.both, o.a + o.b),
+		Jaccard: ratio(o.both, o.a + o.b - o.both),
+	}
+}
+
+func ratio(n, d int) stat {
+	if d == 0 {
+		return stat(math.NaN())
+	}
+	return stat(float64(n) / float64(d))
+}
+
+// Start and end character offsets of each word in the text.
+func textTokens(text []rune) [][2]int {
+	tokens := [][2]int{}
+	start := -1
+	for j, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = j
+		} else if !word && start >= 0 {
+			tokens = append(tokens, [2]int{start, j})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, [2]int{start, len(text)})
+	}
+	return tokens
+}
+
+// Which tokens overlap any of the tags.
+func taggedTokens(tokens [][2]int, tags []Tag) []bool {
+	covered := make([]bool, len(tokens))
+	for _, t := range tags {
+		k := sort.Search(len(tokens), func(n int) bool { return int64(tokens[n][1]) > t.Start })
+		for ; k < len(tokens) && int64(tokens[k][0]) < t.End; k++ {
+			covered[k] = true
+		}
+	}
+	return covered
+}
+
+func (i *Instance) tagAgreementReport(category string) (*TagAgreementReport, error) {
+	assessments, err := dbGetAssessments(i.db)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := dbGetLiveTags(i.db)
+	if err != nil {
+		return nil, err
+	}
+	users, err := dbGetUsers(i.db)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int64]string{}
+	for _, u := range users {
+		names[u.Id] = u.Name
+	}
+
+	// topic -> doc -> assessors who judged it
+	judged := map[int64]map[int64][]int64{}
+	for _, a := range assessments {
+		if _, ok := judged[a.TopicId]; !ok {
+			judged[a.TopicId] = map[int64][]int64{}
+		}
+		judged[a.TopicId][a.DocId] = append(judged[a.TopicId][a.DocId], a.UserId)
+	}
+
+	type docKey struct{ topic, doc int64 }
+	byDoc := map[docKey]map[int64][]Tag{}
+	for _, t := range tags {
+		if category != "" && t.Category != category {
+			continue
+		}
+		k := docKey{t.TopicId, t.DocId}
+		if _, ok := byDoc[k]; !ok {
+			byDoc[k] = map[int64][]Tag{}
+		}
+		byDoc[k][t.UserId] = append(byDoc[k][t.UserId], t)
+	}
+
+	// Only decisions with tags to compare are fetched.
+	ids := []string{}
+	seen := map[int64]bool{}
+	for k := range byDoc {
+		if len(judged[k.topic][k.doc]) > 1 && !seen[k.doc] {
+			ids = append(ids, strconv.FormatInt(k.doc, 10))
+			seen[k.doc] = true
+		}
+	}
+	tokens := map[int64][][2]int{}
+	for start := 0; start < len(ids); start += 100 {
+		end := start + 100
+		if end > len(ids) {
+			end = len(ids)
+		}
+		docs, err := i.docs.MultiGet(ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range docs {
+			id, _ := strconv.ParseInt(d.Id, 10, 64)
+			tokens[id] = textTokens(newDocText(d.Html).text)
+		}
+	}
+
+	type pair struct{ a, b int64 }
+	overall := map[pair]*tokenOverlap{}
+	total := tokenOverlap{}
+	report := &TagAgreementReport{Category: category, Topics: []TopicTagAgreement{}, Pairs: []TagPairAgreement{}}
+	for topic, docs := range judged {
+		pairs := map[pair]*tokenOverlap{}
+		topicTotal := tokenOverlap{}
+		n := 0
+		for doc, assessors := range docs {
+			if len(assessors) < 2 {
+				continue
+			}
+			n++
+			sort.Slice(assessors, func(x, y int) bool { return assessors[x] < assessors[y] })
+			toks := tokens[doc]
+			covered := map[int64][]bool{}
+			for _, u := range assessors {
+				covered[u] = taggedTokens(toks, byDoc[docKey{topic, doc}][u])
+			}
+			for x := range assessors {
+				for y := x + 1; y < len(assessors); y++ {
+					p := pair{assessors[x], assessors[y]}
+					o := tokenOverlap{docs: 1}
+					for k := range toks {
+						a, b := covered[p.a][k], covered[p.b][k]
+						if a {
+							o.a++
+						}
+						if b {
+							o.b++
+						}
+						if a && b {
+							o.both++
+						}
+					}
+					if _, ok := pairs[p]; !ok {
+						pairs[p] = &tokenOverlap{}
+					}
+					if _, ok := overall[p]; !ok {
+						overall[p] = &tokenOverlap{}
+					}
+					pairs[p].add(o)
+					overall[p].add(o)
+					topicTotal.add(o)
+				}
+			}
+		}
+		if n == 0 {
+			continue
+		}
+
+		summary := topicTotal.agreement("", "")
+		t := TopicTagAgreement{
+			TopicId: strconv.FormatInt(topic, 10),
+			Docs: n,
+			F1: summary.F1,
+			Jaccard: summary.Jaccard,
+			Pairs: []TagPairAgreement{},
+		}
+		for p, o := range pairs {
+			t.Pairs = append(t.Pairs, o.agreement(names[p.a], names[p.b]))
+		}
+		sortTagPairs(t.Pairs)
+		report.Topics = append(report.Topics, t)
+		total.add(topicTotal)
+	}
+
+	for p, o := range overall {
+		report.Pairs = append(report.Pairs, o.agreement(names[p.a], names[p.b]))
+	}
+	sortTagPairs(report.Pairs)
+	sort.Slice(report.Topics, func(a, b int) bool {
+		x, _ := strconv.Atoi(report.Topics[a].TopicId)
+		y, _ := strconv.Atoi(report.Topics[b].TopicId)
+		return x < y
+	})
+	summary := total.agreement("", "")
+	report.F1, report.Jaccard = summary.F1, summary.Jaccard
+	return report, nil
+}
+
+func sortTagPairs(p []TagPairAgreement) {
+	sort.Slice(p, func(x, y int) bool {
+		if p[x].A != p[y].A {
+			return p[x].A < p[y].A
+		}
+		return p[x].B < p[y].B
+	})
+}
+
+// Every tag that hasn't been deleted.
+func dbGetLiveTags(db *sql.DB) ([]Tag, error) {
+	rows, err := db.Query("SELECT tag_id, topic_id, doc_id, tagger, start_char, end_char, category FROM tag WHERE deleted_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	tags := make([]Tag, 0)
+	for rows.Next() {
+		var t Tag
+		err = rows.Scan(&t.TagId, &t.TopicId, &t.DocId, &t.UserId, &t.Start, &t.End, &t.Category)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// GET /admin/agreement/tags?category=holding
+func tagAgreementHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	report, err := i.tagAgreementReport(r.FormValue("category"))
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(report)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
@@ -4,9 +4,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -26,27 +29,34 @@ CREATE TABLE tag (
 
 	date_added TIMESTAMP,
 
-	start_pos bigint NOT NULL,
+	start_char bigint NOT NULL,
 
-	end_pos bigint NOT NULL,
+	end_char bigint NOT NULL,
 
-	start_offset bigint NOT NULL,
+	quote TEXT NOT NULL,
 
-	end_offset bigint NOT NULL,
+	category VARCHAR(255) NOT NULL DEFAULT '',
 
-	start_container VARCHAR NOT NULL,
+	note TEXT NOT NULL DEFAULT '',
 
-	end_container VARCHAR NOT NULL,
+	relevant assessType,
 
-	start_id INT NOT NULL,
+	deleted_at TIMESTAMP,
 
-	end_id INT NOT NULL,
+	deleted_by int,
 
 	PRIMARY KEY (topic_id, doc_id, tagger, date_added),
 
-	FOREIGN KEY (tagger) REFERENCES users (user_id)
+	FOREIGN KEY (tagger) REFERENCES users (user_id),
 
-);*/
+	FOREIGN KEY (deleted_by) REFERENCES users (user_id)
+
+);
+
+Edits keep the tag's id and creation date, the versions they replace are kept
+in tag_history, see database.sql.*/
+
+var defaultTagCategories = []string{"holding", "rule statement", "reasoning", "facts", "procedural"}
 
 type Tag struct {
 
@@ -60,21 +70,24 @@ type Tag struct {
 
 	Date time.Time 	`json:"-"`
 
+	// Character offsets into the decision's plain text, see doctext.go.
 	Start int64 `json:"start"`
 
 	End int64 `json:"end"`
 
-	StartOffset int64 `json:"start_offset"`
-
-	EndOffset int64 `json:"end_offset"`
+	// The tagged text, used to find the tag again if the decision changes.
+	Quote string `json:"quote"`
 
-	StartContainer string `json:"start_container"`
+	// Why the span matters, one of Config.Tags.Categories.
+	Category string `json:"category"`
 
-	EndContainer string `json:"end_container"`
+	Note string `json:"note"`
 
-	StartId int `json:"start_id"`
+	// Optional assessType label for the span itself.
+	Relevance string `json:"relevance,omitempty"`
 
-	EndId int `json:"end_id"`
+	// Set when the quote can no longer be found in the decision.
+	Orphaned bool `json:"orphaned,omitempty"`
 
 }
 
@@ -96,11 +109,22 @@ func getTagHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, er
 	}
 
 	log.Printf("user %d - getting tags for %s - %s.\n", auth, topicId, docId)
+	ok, err = i.canViewTopic(auth, topicId)
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
 
 	tags, err := dbGetTags(i.db, topicId, docId, auth)
 	if err != nil {
 		return 500, err
 	}
+	tags, err = i.anchorTags(docId, tags)
+	if err != nil {
+		return 500, err
+	}
 	wr, err := json.Marshal(tags)
 	if err != nil {
 		return 500, err
@@ -111,9 +135,7 @@ func getTagHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, er
 }
 
 func dbGetTags(db *sql.DB, topicId, docId string, userId int64) ([]Tag, error) {
-	var rows *sql.Rows
-	var err error
-	rows, err = db.Query("SELECT tag_id, doc_id, start_offset, end_offset, start_container, end_container, start_id, end_id FROM tag WHERE topic_id = $1 AND doc_id = $2 AND tagger = $3",
+	rows, err := db.Query("SELECT tag_id, doc_id, start_char, end_char, quote, category, note, relevant FROM tag WHERE topic_id = $1 AND doc_id = $2 AND tagger = $3 AND deleted_at IS NULL ORDER BY start_char",
 		topicId, docId, userId)
 	if err != nil {
 		return nil, err
@@ -122,34 +144,82 @@ func dbGetTags(db *sql.DB, topicId, docId string, userId int64) ([]Tag, error) {
 	defer rows.Close()
 	tags := make([]Tag, 0)
 	for rows.Next() {
-		var tag_id int
-		var doc_id int64
-		var start_offset int64
-		var end_offset int64
-		var start_container string
-		var end_container string
-		var start_id int
-		var end_id int
-
-		err := rows.Scan(&tag_id, &doc_id, &start_offset, &end_offset,
-			&start_container, &end_container, &start_id, &end_id)
+		var t Tag
+		var relevant sql.NullString
+		err := rows.Scan(&t.TagId, &t.DocId, &t.Start, &t.End, &t.Quote,
+			&t.Category, &t.Note, &relevant)
 		if err != nil {
 			return nil, err
 		}
-		tags = append(tags, Tag{
-			TagId: tag_id,
-			DocId: doc_id,
-			StartOffset: start_offset,
-			EndOffset: end_offset,
-			StartContainer: start_container,
-			EndContainer: end_container,
-			StartId: start_id,
-			EndId: end_id,
-		})
+		t.Relevance = relevant.String
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// Checks each tag still quotes the decision at its offsets, moving tags whose
+// text has moved (ie. after re-indexing) and marking those that can't be found
+// as orphaned. Nothing is saved, reanchor-tags does that.
+func (i *Instance) anchorTags(docId string, tags []Tag) ([]Tag, error) {
+	if len(tags) == 0 {
+		return tags, nil
+	}
+	dec, err := i.docs.Get(docId)
+	if err == errDocumentNotFound {
+		for j := range tags {
+			tags[j].Orphaned = true
+		}
+		return tags, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	text := newDocText(dec.Html)
+	for j := range tags {
+		reanchorTag(text, &tags[j])
 	}
 	return tags, nil
 }
 
+// Finds the tag's quote in text, returning whether the tag has moved.
+func reanchorTag(text *docText, t *Tag) bool {
+	start, end, ok := text.anchor(t.Quote, int(t.Start), int(t.End))
+	if !ok {
+		t.Orphaned = true
+		return false
+	}
+	if int64(start) == t.Start && int64(end) == t.End {
+		return false
+	}
+	t.Start, t.End = int64(start), int64(end)
+	t.Quote, _ = text.slice(start, end)
+	return true
+}
+
+// Saves a re-anchored tag's offsets and quote, the version it replaces goes to
+// tag_history with no editor.
+func dbMoveTag(db *sql.DB, t Tag) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO tag_history (tag_id, start_char, end_char, quote, category, note, relevant, date_replaced, edited_by)
+		SELECT tag_id, start_char, end_char, quote, category, note, relevant, $1, NULL FROM tag WHERE tag_id = $2`,
+		time.Now(), t.TagId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("UPDATE tag SET start_char = $1, end_char = $2, quote = $3 WHERE tag_id = $4",
+		t.Start, t.End, t.Quote, t.TagId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
 // Save tags -------------------------------------------------------------------
 
 func apiSaveTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
@@ -169,9 +239,28 @@ func apiSaveTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error
 
 	var tag Tag
 	err = json.Unmarshal(body, &tag)
+	if err != nil {
+		return 400, err
+	}
+
+	topicId := strconv.FormatInt(tag.TopicId, 10)
+	ok, err := i.canViewTopic(auth, topicId)
 	if err != nil {
 		return 500, err
 	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %s not assigned", auth, topicId)
+	}
+
+	err = i.validateTag(tag)
+	if err != nil {
+		return 400, err
+	}
+
+	status, err := i.anchorNewTag(&tag)
+	if err != nil {
+		return status, err
+	}
 
 	tag.UserId = auth
 	tag.Date = time.Now()
@@ -181,7 +270,8 @@ func apiSaveTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error
 		return 500, err
 	}
 	log.Println("InsertId -", insertId)
-	buff, err := json.Marshal(struct{ Id int `json:"id"`}{Id: insertId}, )
+	tag.TagId = insertId
+	buff, err := json.Marshal(tag)
 	if err != nil {
 		return 500, err
 	}
@@ -191,19 +281,234 @@ func apiSaveTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error
 	return 200, nil
 }
 
+// The offsets come from the page, the saved ones and quote are always those
+// of the decision's plain text.
+func (i *Instance) anchorNewTag(t *Tag) (int, error) {
+	dec, err := i.docs.Get(strconv.FormatInt(t.DocId, 10))
+	if err == errDocumentNotFound {
+		return 404, err
+	}
+	if err != nil {
+		return 500, err
+	}
+	text := newDocText(dec.Html)
+	start, end, ok := text.anchor(t.Quote, int(t.Start), int(t.End))
+	if !ok || start == end {
+		return 400, errors.New("Tagged text not found in the decision")
+	}
+	t.Start, t.End = int64(start), int64(end)
+	t.Quote, _ = text.slice(start, end)
+	return 200, nil
+}
+
+func (i *Instance) tagCategories() []string {
+	if len(i.config.Tags.Categories) > 0 {
+		return i.config.Tags.Categories
+	}
+	return defaultTagCategories
+}
+
+func (i *Instance) validateTag(t Tag) error {
+	known := false
+	for _, c := range i.tagCategories() {
+		known = known || c == t.Category
+	}
+	if !known {
+		return fmt.Errorf("Unknown tag category %q", t.Category)
+	}
+	if _, ok := i.grades()[t.Relevance]; t.Relevance != "" && !ok {
+		return fmt.Errorf("Unknown relevance %q", t.Relevance)
+	}
+	return nil
+}
+
 func dbSaveTag(db *sql.DB, t Tag) (int, error) {
 	var tag_id int
-	err := db.QueryRow("INSERT INTO tag (topic_id, doc_id, tagger, date_added, start_pos, end_pos, start_offset, end_offset, start_container, end_container, start_id, end_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING tag_id",
-		t.TopicId, t.DocId, t.UserId, t.Date, t.Start, t.End, t.StartOffset,
-			t.EndOffset, t.StartContainer, t.EndContainer, t.StartId, t.EndId).Scan(&tag_id)
+	err := db.QueryRow("INSERT INTO tag (topic_id, doc_id, tagger, date_added, start_char, end_char, quote, category, note, relevant) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING tag_id",
+		t.TopicId, t.DocId, t.UserId, t.Date, t.Start, t.End, t.Quote,
+			t.Category, t.Note, sql.NullString{String: t.Relevance, Valid: t.Relevance != ""}).Scan(&tag_id)
 
 	return tag_id, err
 }
 
 
+// Edit tag --------------------------------------------------------------------
+
+// PUT /tag/{id} {"start", "end", "quote", "category", "note", "relevance"},
+// moves a tag's edges or changes its category, note or grade. The tag keeps
+// its id and creation date, and the version it replaces goes to tag_history.
+func apiEditTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	if auth < 0 {
+		return 401, errors.New("Unauthorized")
+	}
+
+	tagId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, err
+	}
+	status, err := i.checkTagOwner(auth, tagId)
+	if err != nil {
+		return status, err
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 500, err
+	}
+	var edit Tag
+	err = json.Unmarshal(body, &edit)
+	if err != nil {
+		return 400, err
+	}
+
+	tag, err := dbGetTag(i.db, tagId)
+	if err == sql.ErrNoRows {
+		return 404, fmt.Errorf("No tag %d", tagId)
+	}
+	if err != nil {
+		return 500, err
+	}
+	tag.Start, tag.End, tag.Quote = edit.Start, edit.End, edit.Quote
+	tag.Category, tag.Note, tag.Relevance = edit.Category, edit.Note, edit.Relevance
+
+	err = i.validateTag(tag)
+	if err != nil {
+		return 400, err
+	}
+	status, err = i.anchorNewTag(&tag)
+	if err != nil {
+		return status, err
+	}
+
+	err = dbEditTag(i.db, tag, auth)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(tag)
+	if err != nil {
+		return 500, err
+	}
+
+	log.Printf("user %d - editing tag - %d.\n", auth, tagId)
+	w.Write(buff)
+	return 200, nil
+}
+
+// A tag that hasn't been deleted.
+func dbGetTag(db *sql.DB, tagId int) (Tag, error) {
+	var t Tag
+	var relevant sql.NullString
+	err := db.QueryRow("SELECT tag_id, topic_id, doc_id, tagger, date_added, start_char, end_char, quote, category, note, relevant FROM tag WHERE tag_id = $1 AND deleted_at IS NULL",
+		tagId).Scan(&t.TagId, &t.TopicId, &t.DocId, &t.UserId, &t.Date, &t.Start,
+			&t.End, &t.Quote, &t.Category, &t.Note, &relevant)
+	t.Relevance = relevant.String
+	return t, err
+}
+
+func dbEditTag(db *sql.DB, t Tag, userId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO tag_history (tag_id, start_char, end_char, quote, category, note, relevant, date_replaced, edited_by)
+		SELECT tag_id, start_char, end_char, quote, category, note, relevant, $1, $2 FROM tag WHERE tag_id = $3`,
+		time.Now(), userId, t.TagId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("UPDATE tag SET start_char = $1, end_char = $2, quote = $3, category = $4, note = $5, relevant = $6 WHERE tag_id = $7",
+		t.Start, t.End, t.Quote, t.Category, t.Note,
+		sql.NullString{String: t.Relevance, Valid: t.Relevance != ""}, t.TagId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GET /tag/{id}/history, earlier versions of a tag, oldest first.
+func tagHistoryHandler(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	auth, err := i.authed(r)
+	if err != nil {
+		return 500, err
+	}
+	tagId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 400, err
+	}
+	status, err := i.checkTagOwner(auth, tagId)
+	if err != nil {
+		return status, err
+	}
+
+	history, err := dbGetTagHistory(i.db, tagId)
+	if err != nil {
+		return 500, err
+	}
+	buff, err := json.Marshal(history)
+	if err != nil {
+		return 500, err
+	}
+	w.Write(buff)
+	return 200, nil
+}
+
+type tagVersion struct {
+
+	Tag
+
+	Replaced time.Time `json:"replaced"`
+
+	// 0 when reanchor-tags moved the tag.
+	EditedBy int64 `json:"edited_by"`
+
+}
+
+func dbGetTagHistory(db *sql.DB, tagId int) ([]tagVersion, error) {
+	rows, err := db.Query("SELECT tag_id, start_char, end_char, quote, category, note, relevant, date_replaced, edited_by FROM tag_history WHERE tag_id = $1 ORDER BY date_replaced, history_id",
+		tagId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	history := make([]tagVersion, 0)
+	for rows.Next() {
+		var v tagVersion
+		var relevant sql.NullString
+		var editor sql.NullInt64
+		err = rows.Scan(&v.TagId, &v.Start, &v.End, &v.Quote, &v.Category, &v.Note,
+			&relevant, &v.Replaced, &editor)
+		if err != nil {
+			return nil, err
+		}
+		v.Relevance = relevant.String
+		v.EditedBy = editor.Int64
+		history = append(history, v)
+	}
+	return history, rows.Err()
+}
+
 // Delete tag ------------------------------------------------------------------
 
+// Tags are only marked deleted, so a delete can be undone and the record of
+// who tagged what is kept.
 func apiDeleteTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	return i.setTagDeleted(w, r, true)
+}
+
+// POST /tag/restore {"id": tag_id}, undoes a delete.
+func apiRestoreTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, error) {
+	return i.setTagDeleted(w, r, false)
+}
+
+func (i *Instance) setTagDeleted(w http.ResponseWriter, r *http.Request, deleted bool) (int, error) {
 	auth, err := i.authed(r)
 	if err != nil {
 		return 500, err
@@ -220,14 +525,229 @@ func apiDeleteTag(i *Instance, w http.ResponseWriter, r *http.Request) (int, err
 
 	var tag struct{ Id int `json:"id"`}
 	err = json.Unmarshal(body, &tag)
-	_, err = dbDeleteTag(i.db, tag.Id)
+	if err != nil {
+		return 400, err
+	}
+
+	status, err := i.checkTagOwner(auth, tag.Id)
+	if err != nil {
+		return status, err
+	}
+
+	if deleted {
+		err = dbDeleteTag(i.db, tag.Id, auth)
+		log.Printf("user %d - deleting tag - %d.\n", auth, tag.Id)
+	} else {
+		status, err = i.checkTagDeleter(auth, tag.Id)
+		if err != nil {
+			return status, err
+		}
+		err = dbRestoreTag(i.db, tag.Id)
+		log.Printf("user %d - restoring tag - %d.\n", auth, tag.Id)
+	}
 	if err != nil {
 		return 500, err
 	}
-	log.Printf("user %d - deleting tag - %d.\n", auth, tag.Id)
 	return 200, nil
 }
 
-func dbDeleteTag(db *sql.DB, tagId int) (sql.Result, error) {
-	return db.Exec("DELETE FROM tag WHERE tag_id = $1", tagId)
+// Only the tagger or an admin can change a tag, and only on a topic they may
+// view.
+func (i *Instance) checkTagOwner(userId int64, tagId int) (int, error) {
+	tagger, topicId, err := dbGetTagger(i.db, tagId)
+	if err == sql.ErrNoRows {
+		return 404, fmt.Errorf("No tag %d", tagId)
+	}
+	if err != nil {
+		return 500, err
+	}
+	ok, err := i.canViewTopic(userId, strconv.FormatInt(topicId, 10))
+	if err != nil {
+		return 500, err
+	}
+	if !ok {
+		return 403, fmt.Errorf("user %d - topic %d not assigned", userId, topicId)
+	}
+	if tagger == userId {
+		return 200, nil
+	}
+	role, err := dbGetUserRole(i.db, userId)
+	if err != nil {
+		return 500, err
+	}
+	if role != roleAdmin {
+		return 403, errors.New("Forbidden")
+	}
+	return 200, nil
+}
+
+// Only whoever deleted a tag or an admin can restore it, so an owner can't undo
+// an admin's delete.
+func (i *Instance) checkTagDeleter(userId int64, tagId int) (int, error) {
+	var deleter sql.NullInt64
+	err := i.db.QueryRow("SELECT deleted_by FROM tag WHERE tag_id = $1", tagId).Scan(&deleter)
+	if err != nil {
+		return 500, err
+	}
+	if !deleter.Valid {
+		return 400, fmt.Errorf("Tag %d is not deleted", tagId)
+	}
+	if deleter.Int64 == userId {
+		return 200, nil
+	}
+	role, err := dbGetUserRole(i.db, userId)
+	if err != nil {
+		return 500, err
+	}
+	if role != roleAdmin {
+		return 403, errors.New("Forbidden")
+	}
+	return 200, nil
+}
+
+func dbGetTagger(db *sql.DB, tagId int) (int64, int64, error) {
+	var tagger, topicId int64
+	err := db.QueryRow("SELECT tagger, topic_id FROM tag WHERE tag_id = $1", tagId).Scan(&tagger, &topicId)
+	return tagger, topicId, err
+}
+
+func dbDeleteTag(db *sql.DB, tagId int, userId int64) error {
+	_, err := db.Exec("UPDATE tag SET deleted_at = $1, deleted_by = $2 WHERE tag_id = $3 AND deleted_at IS NULL",
+		time.Now(), userId, tagId)
+	return err
+}
+
+func dbRestoreTag(db *sql.DB, tagId int) error {
+	_, err := db.Exec("UPDATE tag SET deleted_at = NULL, deleted_by = NULL WHERE tag_id = $1", tagId)
+	return err
+}
+
+// Re-anchor tags -----------------------------------------------------------------
+
+// Checks every tag against its decision, ie. after re-indexing. With -legacy,
+// first converts tags saved with html positions before tags had quotes.
+func reanchorTagsCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("reanchor-tags", flag.ExitOnError)
+	legacy := fs.Bool("legacy", false, "Convert tags with html positions (start_pos, end_pos) and no quote")
+	fs.Parse(args)
+
+	if *legacy {
+		err := convertLegacyTags(i)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := i.db.Query("SELECT tag_id, doc_id, start_char, end_char, quote FROM tag WHERE quote IS NOT NULL ORDER BY doc_id")
+	if err != nil {
+		return err
+	}
+	byDoc := map[int64][]Tag{}
+	docs := []int64{}
+	for rows.Next() {
+		var t Tag
+		err = rows.Scan(&t.TagId, &t.DocId, &t.Start, &t.End, &t.Quote)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := byDoc[t.DocId]; !ok {
+			docs = append(docs, t.DocId)
+		}
+		byDoc[t.DocId] = append(byDoc[t.DocId], t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	n, moved, orphaned := 0, 0, 0
+	for _, docId := range docs {
+		tags := byDoc[docId]
+		n += len(tags)
+		dec, err := i.docs.Get(strconv.FormatInt(docId, 10))
+		if err == errDocumentNotFound {
+			orphaned += len(tags)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		text := newDocText(dec.Html)
+		for j := range tags {
+			if reanchorTag(text, &tags[j]) {
+				err = dbMoveTag(i.db, tags[j])
+				if err != nil {
+					return err
+				}
+				moved++
+			}
+			if tags[j].Orphaned {
+				orphaned++
+				fmt.Printf("tag %d - %q not found in %d\n", tags[j].TagId, tags[j].Quote, docId)
+			}
+		}
+	}
+	fmt.Printf("%d tags, %d re-anchored, %d not found\n", n, moved, orphaned)
+	return nil
+}
+
+// Fills start_char, end_char and quote from the html positions tags were
+// saved with, see the migration notes in database.sql. The positions are
+// javascript string indexes, counting UTF-16 code units.
+func convertLegacyTags(i *Instance) error {
+	type legacyTag struct{ id, doc, start, end int64 }
+	rows, err := i.db.Query("SELECT tag_id, doc_id, start_pos, end_pos FROM tag WHERE quote IS NULL")
+	if err != nil {
+		return err
+	}
+	tags := []legacyTag{}
+	for rows.Next() {
+		var t legacyTag
+		err = rows.Scan(&t.id, &t.doc, &t.start, &t.end)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tags = append(tags, t)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	texts := map[int64]*docText{}
+	htmls := map[int64]string{}
+	converted := 0
+	for _, t := range tags {
+		text, ok := texts[t.doc]
+		if !ok {
+			dec, err := i.docs.Get(strconv.FormatInt(t.doc, 10))
+			if err == errDocumentNotFound {
+				fmt.Printf("tag %d - decision %d not found\n", t.id, t.doc)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			text = newDocText(dec.Html)
+			texts[t.doc] = text
+			htmls[t.doc] = dec.Html
+		}
+		start := text.fromHtml(runeOffset(htmls[t.doc], int(t.start)))
+		end := text.fromHtml(runeOffset(htmls[t.doc], int(t.end)))
+		quote, ok := text.slice(start, end)
+		if !ok {
+			fmt.Printf("tag %d - positions %d - %d out of range\n", t.id, t.start, t.end)
+			continue
+		}
+		_, err = i.db.Exec("UPDATE tag SET start_char = $1, end_char = $2, quote = $3 WHERE tag_id = $4",
+			start, end, quote, t.id)
+		if err != nil {
+			return err
+		}
+		converted++
+	}
+	fmt.Printf("%d of %d legacy tags converted\n", converted, len(tags))
+	return nil
 }
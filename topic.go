@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
@@ -155,7 +156,8 @@ func loadTopics(dir, path, fileName string, load, update bool) (*map[string]Topi
 }
 
 // TODO need to add here upper number to be assessed....
-func (i *Instance) getTopicList(user int64) (TopicIndex, error) {
+// Lists the topics assigned to user, or every topic if all is set.
+func (i *Instance) getTopicList(user int64, all bool) (TopicIndex, error) {
 	l := TopicIndex{}
 
 	assessed, err := dbGetNumberAssessedPerTopic(i.db, user)
@@ -164,12 +166,33 @@ func (i *Instance) getTopicList(user int64) (TopicIndex, error) {
 		return nil, err
 	}
 
+	assigned, err := dbGetUserAssignments(i.db, user)
+	if err != nil {
+		return nil, err
+	}
+
 	for k, v := range i.topics {
+		if !all && !assigned[k] {
+			continue
+		}
 		l = append(l, struct{Topic string; Name string; Assessed int}{k, v.CaseTitle, assessed[k]})
 	}
 	return l, nil
 }
 
+func (i *Instance) initTopics(load, update bool) error {
+	topics, err := loadTopics(i.dir, i.config.Topics.Location,
+		i.config.Topics.DataFileName, load, update)
+	if err != nil {
+		return err
+	}
+	if topics == nil {
+		return errors.New("No topics loaded, use -l or -u")
+	}
+	i.topics = *topics
+	return nil
+}
+
 func (i *Instance) getTopic(topic string) Topic {
 	return i.topics[topic]
 }
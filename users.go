@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+type User struct {
+
+	Id int64
+
+	Name string
+
+	Role string
+
+}
+
+func dbAddUser(db *sql.DB, name, pass, role string) (int64, error) {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return 0, err
+	}
+	var user_id int64
+	err = db.QueryRow("INSERT INTO users (name, pass, role) VALUES ($1, $2, $3) RETURNING user_id",
+		name, hash, role).Scan(&user_id)
+	return user_id, err
+}
+
+func dbSetUserPassword(db *sql.DB, name, pass string) (sql.Result, error) {
+	hash, err := hashPassword(pass)
+	if err != nil {
+		return nil, err
+	}
+	return db.Exec("UPDATE users SET pass = $1 WHERE name = $2", hash, name)
+}
+
+func dbSetUserRole(db *sql.DB, name, role string) (sql.Result, error) {
+	return db.Exec("UPDATE users SET role = $1 WHERE name = $2", role, name)
+}
+
+func dbDeleteUser(db *sql.DB, name string) (sql.Result, error) {
+	return db.Exec("DELETE FROM users WHERE name = $1", name)
+}
+
+func dbGetUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT user_id, name, role FROM users ORDER BY user_id")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	users := make([]User, 0)
+	for rows.Next() {
+		var u User
+		err := rows.Scan(&u.Id, &u.Name, &u.Role)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Reads a password from the terminal without echo, or a single line from
+// stdin when it is not a terminal so the commands can be scripted.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Print(prompt)
+		pass, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		return string(pass), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readNewPassword() (string, error) {
+	pass, err := readPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", errors.New("Password must not be empty")
+	}
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		confirm, err := readPassword("Confirm password: ")
+		if err != nil {
+			return "", err
+		}
+		if confirm != pass {
+			return "", errors.New("Passwords do not match")
+		}
+	}
+	return pass, nil
+}
+
+// User management commands ----------------------------------------------------
+
+func userAddCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("useradd", flag.ExitOnError)
+	role := fs.String("role", roleAssessor, "User role (admin, assessor, observer or adjudicator)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: useradd [-role role] <name>")
+	}
+	name := strings.ToLower(fs.Arg(0))
+	if !validRole(*role) {
+		return fmt.Errorf("Unknown role %s", *role)
+	}
+
+	pass, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+	id, err := dbAddUser(i.db, name, pass, *role)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s %s (%d).\n", *role, name, id)
+	return nil
+}
+
+func passwdCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: passwd <name>")
+	}
+	name := strings.ToLower(fs.Arg(0))
+
+	pass, err := readNewPassword()
+	if err != nil {
+		return err
+	}
+	res, err := dbSetUserPassword(i.db, name, pass)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("No such user %s", name)
+	}
+	fmt.Printf("password updated for %s.\n", name)
+	return nil
+}
+
+func userRoleCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("role", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: role <name> <role>")
+	}
+	name := strings.ToLower(fs.Arg(0))
+	role := fs.Arg(1)
+	if !validRole(role) {
+		return fmt.Errorf("Unknown role %s", role)
+	}
+
+	res, err := dbSetUserRole(i.db, name, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("No such user %s", name)
+	}
+	fmt.Printf("%s is now %s.\n", name, role)
+	return nil
+}
+
+func userDelCommand(i *Instance, args []string) error {
+	fs := flag.NewFlagSet("userdel", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: userdel <name>")
+	}
+	name := strings.ToLower(fs.Arg(0))
+
+	res, err := dbDeleteUser(i.db, name)
+	if err != nil {
+		return fmt.Errorf("Could not delete %s, users with assessments, tags or queries cannot be removed: %v", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("No such user %s", name)
+	}
+	fmt.Printf("deleted user %s.\n", name)
+	return nil
+}
+
+func userListCommand(i *Instance, args []string) error {
+	users, err := dbGetUsers(i.db)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		fmt.Printf("%d\t%s\t%s\n", u.Id, u.Name, u.Role)
+	}
+	return nil
+}